@@ -0,0 +1,264 @@
+package main
+
+import (
+	admin "cloud.google.com/go/iam/admin/apiv1"
+	"cloud.google.com/go/iam/admin/apiv1/adminpb"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	iamv1 "google.golang.org/api/iam/v1"
+	"google.golang.org/api/iterator"
+	"strings"
+)
+
+// serviceAccountMarker ends the description of the service accounts gruns
+// owns. Service accounts have no labels.
+const serviceAccountMarker = "[managed by " + tag + "]"
+
+// serviceAccountAdmin is the subset of the IAM admin client used by gruns, so
+// that it can be faked in tests.
+type serviceAccountAdmin interface {
+	ListAccounts(ctx context.Context, project string) ([]*adminpb.ServiceAccount, error)
+	CreateServiceAccount(ctx context.Context, req *adminpb.CreateServiceAccountRequest, opts ...gax.CallOption) (*adminpb.ServiceAccount, error)
+	PatchServiceAccount(ctx context.Context, sa *adminpb.ServiceAccount) error
+	DeleteServiceAccount(ctx context.Context, req *adminpb.DeleteServiceAccountRequest, opts ...gax.CallOption) error
+}
+
+// iamAdmin adds ListAccounts and PatchServiceAccount to the IAM admin client.
+// The client can only update the display name of an account, so patches go
+// through the REST API.
+type iamAdmin struct {
+	*admin.IamClient
+	rest *iamv1.Service
+}
+
+// PatchServiceAccount sets the display name and the description of the
+// account sa.
+func (a iamAdmin) PatchServiceAccount(ctx context.Context, sa *adminpb.ServiceAccount) error {
+	_, err := a.rest.Projects.ServiceAccounts.Patch(sa.Name, &iamv1.PatchServiceAccountRequest{
+		ServiceAccount: &iamv1.ServiceAccount{
+			DisplayName:     sa.DisplayName,
+			Description:     sa.Description,
+			Etag:            base64.StdEncoding.EncodeToString(sa.Etag),
+			ForceSendFields: []string{"DisplayName", "Description"},
+		},
+		UpdateMask: "display_name,description",
+	}).Context(ctx).Do()
+	return err
+}
+
+// ListAccounts returns all service accounts of project.
+func (a iamAdmin) ListAccounts(ctx context.Context, project string) ([]*adminpb.ServiceAccount, error) {
+	it := a.ListServiceAccounts(ctx, &adminpb.ListServiceAccountsRequest{Name: "projects/" + project, PageSize: 100})
+	var accounts []*adminpb.ServiceAccount
+	for {
+		sa, err := it.Next()
+		if err == iterator.Done {
+			return accounts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, sa)
+	}
+}
+
+// collectServiceAccounts gathers the service accounts of files, reporting
+// accounts that are declared more than once.
+func collectServiceAccounts(files []*jobFile) ([]serviceAccount, error) {
+	var accounts []serviceAccount
+	var errs errorList
+	defined := map[string]position{}
+	for _, f := range files {
+		n := mappingValue(f.body, "service_accounts")
+		if n == nil {
+			continue
+		}
+		for _, item := range n.Content {
+			if isDeleted(item) {
+				continue
+			}
+			var a serviceAccount
+			err := removeDeleted(item).Decode(&a)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not unmarshal %s", f.path)
+			}
+			a.pos = position{File: f.path, Line: item.Line, Column: item.Column}
+			if first, ok := defined[a.Name]; ok {
+				errs = append(errs, positionError{a.pos, fmt.Sprintf("duplicate service account %q, first defined at %s", a.Name, first)})
+				continue
+			}
+			defined[a.Name] = a.pos
+			accounts = append(accounts, a)
+		}
+	}
+	return accounts, errs.err()
+}
+
+func serviceAccountEmail(project, name string) string {
+	return fmt.Sprintf("%s@%s.iam.gserviceaccount.com", name, project)
+}
+
+// resolveServiceAccounts replaces the service accounts of the jobs and their
+// triggers that are given by name with the email of the declared account.
+func resolveServiceAccounts(project string, accounts []serviceAccount, jobs []job) ([]job, error) {
+	var errs errorList
+	resolve := func(j job, field, account string) string {
+		if account == "" || strings.Contains(account, "@") {
+			return account
+		}
+		if pie.FindFirstUsing(accounts, func(a serviceAccount) bool { return a.Name == account }) >= 0 {
+			return serviceAccountEmail(project, account)
+		}
+		pos := j.pos
+		if o, ok := j.origins[field]; ok {
+			pos = o.Pos
+		}
+		errs = append(errs, positionError{pos, fmt.Sprintf("job %q: %s: unknown service account %q, declare it in service_accounts or use its email", j.Name, field, account)})
+		return account
+	}
+
+	for i, j := range jobs {
+		jobs[i].ServiceAccount = resolve(j, "service_account", j.ServiceAccount)
+		if j.Trigger != nil {
+			trigger := *j.Trigger
+			trigger.ServiceAccount = resolve(j, "trigger.service_account", trigger.ServiceAccount)
+			jobs[i].Trigger = &trigger
+		}
+	}
+	return jobs, errs.err()
+}
+
+// serviceAccountDescription returns the description of the account a with the
+// marker of the accounts gruns owns.
+func serviceAccountDescription(a serviceAccount) string {
+	return strings.TrimSpace(a.Description + " " + serviceAccountMarker)
+}
+
+func ownsServiceAccount(sa *adminpb.ServiceAccount) bool {
+	return strings.HasSuffix(sa.Description, serviceAccountMarker)
+}
+
+// accountPlan holds the changes to the service accounts.
+type accountPlan struct {
+	create []serviceAccount
+	update []*adminpb.ServiceAccount
+	remove []*adminpb.ServiceAccount
+	// owned holds the members of the accounts gruns owns, including the
+	// accounts it removes.
+	owned []string
+}
+
+func (p accountPlan) changes() []string {
+	var changes []string
+	for _, a := range p.create {
+		changes = append(changes, fmt.Sprintf("+ service_account %s [%s]", a.Name, a.pos))
+	}
+	for _, sa := range p.update {
+		changes = append(changes, fmt.Sprintf("~ service_account %s", sa.Email))
+	}
+	for _, sa := range p.remove {
+		changes = append(changes, fmt.Sprintf("- service_account %s", sa.Email))
+	}
+	return changes
+}
+
+// planServiceAccounts compares the declared accounts with the accounts of the
+// project. Missing accounts are created and the display name and description
+// of the accounts gruns owns are updated. An existing account gruns does not
+// own is not taken over. Accounts gruns owns are removed once they are neither
+// declared nor used by a job.
+func (c *service) planServiceAccounts(ctx context.Context, accounts []serviceAccount, jobs []job) (accountPlan, error) {
+	existing, err := c.accounts.ListAccounts(ctx, c.project)
+	if err != nil {
+		return accountPlan{}, errors.Wrapf(err, "could not list the service accounts of %s", c.project)
+	}
+	byEmail := map[string]*adminpb.ServiceAccount{}
+	for _, sa := range existing {
+		byEmail[sa.Email] = sa
+	}
+
+	var plan accountPlan
+	var errs errorList
+	declared := map[string]bool{}
+	for _, a := range accounts {
+		email := serviceAccountEmail(c.project, a.Name)
+		declared[email] = true
+		sa, ok := byEmail[email]
+		switch {
+		case !ok:
+			plan.create = append(plan.create, a)
+		case !ownsServiceAccount(sa):
+			errs = append(errs, positionError{a.pos, fmt.Sprintf("service account %s exists but is not managed by gruns, add %q to its description to let gruns manage it", email, serviceAccountMarker)})
+			continue
+		case sa.DisplayName != a.DisplayName || sa.Description != serviceAccountDescription(a):
+			plan.update = append(plan.update, &adminpb.ServiceAccount{
+				Name:        sa.Name,
+				Email:       sa.Email,
+				Etag:        sa.Etag,
+				DisplayName: a.DisplayName,
+				Description: serviceAccountDescription(a),
+			})
+		}
+		plan.owned = append(plan.owned, "serviceAccount:"+email)
+	}
+
+	used := map[string]bool{}
+	for _, j := range jobs {
+		used[c.jobAccount(j)] = true
+		used[c.triggerAccount(j)] = true
+	}
+	for _, sa := range existing {
+		if declared[sa.Email] || !ownsServiceAccount(sa) {
+			continue
+		}
+		plan.owned = append(plan.owned, "serviceAccount:"+sa.Email)
+		if used[sa.Email] {
+			log.Warn().Msgf("service account %s is no longer declared but still used by a job, keeping it", sa.Email)
+			continue
+		}
+		plan.remove = append(plan.remove, sa)
+	}
+	return plan, errs.err()
+}
+
+// createServiceAccounts creates and updates the accounts of plan.
+func (c *service) createServiceAccounts(ctx context.Context, plan accountPlan) error {
+	for _, a := range plan.create {
+		_, err := c.accounts.CreateServiceAccount(ctx, &adminpb.CreateServiceAccountRequest{
+			Name:      "projects/" + c.project,
+			AccountId: a.Name,
+			ServiceAccount: &adminpb.ServiceAccount{
+				DisplayName: a.DisplayName,
+				Description: serviceAccountDescription(a),
+			},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not create service account %s", a.Name)
+		}
+		log.Debug().Msgf("created service account %s", a.Name)
+	}
+	for _, sa := range plan.update {
+		err := c.accounts.PatchServiceAccount(ctx, sa)
+		if err != nil {
+			return errors.Wrapf(err, "could not update service account %s", sa.Email)
+		}
+	}
+	return nil
+}
+
+// deleteServiceAccounts deletes the accounts plan removes.
+func (c *service) deleteServiceAccounts(ctx context.Context, plan accountPlan) error {
+	for _, sa := range plan.remove {
+		log.Debug().Msgf("deleting service account %s", sa.Email)
+		err := c.accounts.DeleteServiceAccount(ctx, &adminpb.DeleteServiceAccountRequest{Name: sa.Name})
+		if err != nil {
+			return errors.Wrapf(err, "could not delete service account %s", sa.Email)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cloud.google.com/go/iam/admin/apiv1/adminpb"
+	"context"
+	"github.com/elliotchance/pie/v2"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// fakeAccounts keeps service accounts in memory.
+type fakeAccounts struct {
+	accounts []*adminpb.ServiceAccount
+	deleted  []string
+	patched  []string
+}
+
+func (f *fakeAccounts) ListAccounts(_ context.Context, _ string) ([]*adminpb.ServiceAccount, error) {
+	return f.accounts, nil
+}
+
+func (f *fakeAccounts) CreateServiceAccount(_ context.Context, req *adminpb.CreateServiceAccountRequest, _ ...gax.CallOption) (*adminpb.ServiceAccount, error) {
+	sa := req.ServiceAccount
+	sa.Email = serviceAccountEmail(lastSegment(req.Name), req.AccountId)
+	sa.Name = req.Name + "/serviceAccounts/" + sa.Email
+	f.accounts = append(f.accounts, sa)
+	return sa, nil
+}
+
+// UpdateServiceAccount only updates the display name, like the IAM admin
+// client, which rejects other changes.
+func (f *fakeAccounts) UpdateServiceAccount(_ context.Context, req *adminpb.ServiceAccount, _ ...gax.CallOption) (*adminpb.ServiceAccount, error) {
+	for _, sa := range f.accounts {
+		if sa.Name == req.Name {
+			if sa.Description != req.Description {
+				return nil, status.Error(codes.InvalidArgument, "only display_name can be updated")
+			}
+			sa.DisplayName = req.DisplayName
+		}
+	}
+	return req, nil
+}
+
+func (f *fakeAccounts) PatchServiceAccount(_ context.Context, req *adminpb.ServiceAccount) error {
+	for _, sa := range f.accounts {
+		if sa.Name == req.Name {
+			sa.DisplayName, sa.Description = req.DisplayName, req.Description
+			f.patched = append(f.patched, req.Name)
+		}
+	}
+	return nil
+}
+
+func (f *fakeAccounts) DeleteServiceAccount(_ context.Context, req *adminpb.DeleteServiceAccountRequest, _ ...gax.CallOption) error {
+	f.deleted = append(f.deleted, req.Name)
+	f.accounts = pie.Filter(f.accounts, func(sa *adminpb.ServiceAccount) bool { return sa.Name != req.Name })
+	return nil
+}
+
+func Test_ServiceAccounts(t *testing.T) {
+	cfg, err := readConfig(readOptions{}, "data/accounts/jobs.yml")
+	require.NoError(t, err)
+	require.Equal(t, []serviceAccount{
+		{Name: "exporter", DisplayName: "Exporter", Description: "Exports the orders to BigQuery.", Roles: []string{"roles/bigquery.dataEditor"}, pos: position{File: "data/accounts/jobs.yml", Line: 2, Column: 5}},
+		{Name: "scheduler", pos: position{File: "data/accounts/jobs.yml", Line: 7, Column: 5}},
+	}, cfg.accounts)
+
+	jobs, err := resolveServiceAccounts("test", cfg.accounts, cfg.jobs)
+	require.NoError(t, err)
+	require.Equal(t, "exporter@test.iam.gserviceaccount.com", jobs[0].ServiceAccount)
+	require.Equal(t, "scheduler@test.iam.gserviceaccount.com", jobs[0].Trigger.ServiceAccount)
+	require.Equal(t, "runner@test.iam.gserviceaccount.com", jobs[1].ServiceAccount)
+
+	accounts := &fakeAccounts{accounts: []*adminpb.ServiceAccount{
+		{Name: "projects/test/serviceAccounts/scheduler@test.iam.gserviceaccount.com", Email: "scheduler@test.iam.gserviceaccount.com", Description: "Old description " + serviceAccountMarker},
+		{Name: "projects/test/serviceAccounts/runner@test.iam.gserviceaccount.com", Email: "runner@test.iam.gserviceaccount.com", Description: serviceAccountMarker},
+		{Name: "projects/test/serviceAccounts/legacy@test.iam.gserviceaccount.com", Email: "legacy@test.iam.gserviceaccount.com", Description: serviceAccountMarker},
+		{Name: "projects/test/serviceAccounts/manual@test.iam.gserviceaccount.com", Email: "manual@test.iam.gserviceaccount.com"},
+	}}
+	projects := fakePolicies{}
+	projects.grant("projects/test", "roles/pubsub.publisher", "serviceAccount:legacy@test.iam.gserviceaccount.com")
+	projects.grant("projects/test", "roles/storage.admin", "serviceAccount:exporter@test.iam.gserviceaccount.com")
+	projects.grant("projects/test", "roles/storage.admin", "serviceAccount:manual@test.iam.gserviceaccount.com")
+	svc := &service{project: "test", region: "europe-west1", accounts: accounts, projects: projects, jobPolicies: fakePolicies{}}
+	ctx := context.Background()
+
+	plan, err := svc.planServiceAccounts(ctx, cfg.accounts, jobs)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"+ service_account exporter [data/accounts/jobs.yml:2:5]",
+		"~ service_account scheduler@test.iam.gserviceaccount.com",
+		"- service_account legacy@test.iam.gserviceaccount.com",
+	}, plan.changes())
+
+	iam, err := svc.planIam(ctx, jobs, cfg.accounts, plan.owned, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"+ iam roles/run.invoker to serviceAccount:scheduler@test.iam.gserviceaccount.com on projects/test/locations/europe-west1/jobs/export",
+		"+ iam roles/bigquery.dataEditor to serviceAccount:exporter@test.iam.gserviceaccount.com on projects/test",
+		"- iam roles/pubsub.publisher to serviceAccount:legacy@test.iam.gserviceaccount.com on projects/test",
+		"- iam roles/storage.admin to serviceAccount:exporter@test.iam.gserviceaccount.com on projects/test",
+	}, iam.changes())
+
+	// The admin client cannot change the description, see PatchServiceAccount.
+	_, err = accounts.UpdateServiceAccount(ctx, plan.update[0])
+	require.ErrorContains(t, err, "only display_name can be updated")
+
+	require.NoError(t, svc.createServiceAccounts(ctx, plan))
+	require.NoError(t, svc.deleteServiceAccounts(ctx, plan))
+	require.Equal(t, []string{"projects/test/serviceAccounts/legacy@test.iam.gserviceaccount.com"}, accounts.deleted)
+	require.Equal(t, []string{"projects/test/serviceAccounts/scheduler@test.iam.gserviceaccount.com"}, accounts.patched)
+
+	plan, err = svc.planServiceAccounts(ctx, cfg.accounts, jobs)
+	require.NoError(t, err)
+	require.Empty(t, plan.changes())
+}
+
+func Test_ServiceAccounts_Errors(t *testing.T) {
+	_, err := readConfig(readOptions{}, "data/accounts/unknown.yml")
+	require.EqualError(t, err, `data/accounts/unknown.yml:3:5: duplicate service account "exporter", first defined at data/accounts/unknown.yml:2:5`)
+
+	jobs := []job{{
+		Name:           "export",
+		ServiceAccount: "importer",
+		pos:            position{File: "jobs.yml", Line: 2, Column: 5},
+		origins:        map[string]origin{"service_account": {Source: "job", Pos: position{File: "jobs.yml", Line: 4, Column: 22}}},
+	}}
+	_, err = resolveServiceAccounts("test", []serviceAccount{{Name: "exporter"}}, jobs)
+	require.EqualError(t, err, `jobs.yml:4:22: job "export": service_account: unknown service account "importer", declare it in service_accounts or use its email`)
+
+	svc := &service{project: "test", accounts: &fakeAccounts{accounts: []*adminpb.ServiceAccount{
+		{Name: "projects/test/serviceAccounts/exporter@test.iam.gserviceaccount.com", Email: "exporter@test.iam.gserviceaccount.com"},
+	}}}
+	_, err = svc.planServiceAccounts(context.Background(), []serviceAccount{{Name: "exporter", pos: position{File: "jobs.yml", Line: 2, Column: 5}}}, nil)
+	require.EqualError(t, err, `jobs.yml:2:5: service account exporter@test.iam.gserviceaccount.com exists but is not managed by gruns, add "[managed by gruns-cli]" to its description to let gruns manage it`)
+}
+
+func Test_ServiceAccounts_DefaultServiceAccount(t *testing.T) {
+	accounts := &fakeAccounts{accounts: []*adminpb.ServiceAccount{
+		{Name: "projects/test/serviceAccounts/runner@test.iam.gserviceaccount.com", Email: "runner@test.iam.gserviceaccount.com", Description: serviceAccountMarker},
+	}}
+	svc := &service{project: "test", accounts: accounts, defaultServiceAccount: "runner@test.iam.gserviceaccount.com"}
+
+	// The --service-account a job runs as without its own is kept.
+	plan, err := svc.planServiceAccounts(context.Background(), nil, []job{{Name: "export"}})
+	require.NoError(t, err)
+	require.Empty(t, plan.changes())
+}
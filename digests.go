@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2/google"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// imageTagAnnotation records on a run job the image tag its digest was
+// resolved from.
+const imageTagAnnotation = "gruns-cli/image-tag"
+
+// manifestMediaTypes are the manifests accepted when resolving a tag. Image
+// indexes come first so that multi-platform images resolve to the index.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var digestRegex = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// imageRef is a parsed image reference, e.g. europe-docker.pkg.dev/p/r/app:v1.
+type imageRef struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// parseImage parses image, following the defaults of docker: images without a
+// registry come from Docker Hub and images without a tag or digest are latest.
+func parseImage(image string) imageRef {
+	var ref imageRef
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.digest = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.tag = name[:i], name[i+1:]
+	}
+	if hasRegistry(name) {
+		ref.registry, ref.repository, _ = strings.Cut(name, "/")
+	} else {
+		ref.registry, ref.repository = "registry-1.docker.io", name
+		if !strings.Contains(name, "/") {
+			ref.repository = "library/" + name
+		}
+	}
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = "latest"
+	}
+	return ref
+}
+
+// digestResolver resolves image tags to digests with the OCI distribution API,
+// caching the result per image.
+type digestResolver struct {
+	client *http.Client
+	// token returns the credentials for registry, if any.
+	token    func(ctx context.Context, registry string) (user, password string, err error)
+	resolved map[string]string
+}
+
+func newDigestResolver() *digestResolver {
+	return &digestResolver{client: http.DefaultClient, token: googleRegistryToken, resolved: map[string]string{}}
+}
+
+// resolveDigests replaces the tag of the image of every job with the digest it
+// currently points to and records the tag on the job. Images that are already
+// pinned to a digest are left alone.
+func (r *digestResolver) resolveDigests(ctx context.Context, jobs []job) ([]job, error) {
+	var errs errorList
+	for i, j := range jobs {
+		ref := parseImage(j.Image)
+		if ref.digest != "" {
+			continue
+		}
+		digest, err := r.resolve(ctx, ref)
+		if err != nil {
+			errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: could not resolve image %s: %s", j.Name, j.Image, err)})
+			continue
+		}
+		jobs[i].imageTag = j.Image
+		jobs[i].Image = strings.TrimSuffix(j.Image, ":"+ref.tag) + "@" + digest
+	}
+	return jobs, errs.err()
+}
+
+func (r *digestResolver) resolve(ctx context.Context, ref imageRef) (string, error) {
+	key := ref.registry + "/" + ref.repository + ":" + ref.tag
+	if digest, ok := r.resolved[key]; ok {
+		return digest, nil
+	}
+
+	scheme := "https"
+	if host := strings.Split(ref.registry, ":")[0]; host == "localhost" || host == "127.0.0.1" {
+		scheme = "http"
+	}
+	manifest := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, ref.registry, ref.repository, ref.tag)
+
+	res, err := r.head(ctx, manifest, "")
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		token, err := r.bearerToken(ctx, ref, res.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", err
+		}
+		res, err = r.head(ctx, manifest, token)
+		if err != nil {
+			return "", err
+		}
+	}
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return "", errors.Errorf("tag %s does not exist", ref.tag)
+	case res.StatusCode != http.StatusOK:
+		return "", errors.Errorf("registry returned %s", res.Status)
+	}
+
+	digest := res.Header.Get("Docker-Content-Digest")
+	if !digestRegex.MatchString(digest) {
+		return "", errors.Errorf("registry returned no sha256 digest for %s", ref.tag)
+	}
+	r.resolved[key] = digest
+	return digest, nil
+}
+
+func (r *digestResolver) head(ctx context.Context, url, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res, nil
+}
+
+// bearerToken answers the Bearer challenge of a registry with a token that
+// can pull the repository of ref.
+func (r *digestResolver) bearerToken(ctx context.Context, ref imageRef, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", errors.Errorf("unsupported authentication %q", scheme)
+	}
+	values := map[string]string{}
+	for _, m := range challengeParamRegex.FindAllStringSubmatch(params, -1) {
+		values[m[1]] = m[2]
+	}
+	realm, err := url.Parse(values["realm"])
+	if err != nil || values["realm"] == "" {
+		return "", errors.Errorf("invalid authentication challenge %q", challenge)
+	}
+	query := realm.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", ref.repository))
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	user, password, err := r.token(ctx, ref.registry)
+	if err != nil {
+		return "", err
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("token endpoint returned %s", res.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid token response")
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// googleRegistryToken returns the application default credentials for the
+// Artifact Registry and Container Registry hosts, and no credentials for other
+// registries.
+func googleRegistryToken(ctx context.Context, registry string) (string, string, error) {
+	if !strings.HasSuffix(registry, ".pkg.dev") && registry != "gcr.io" && !strings.HasSuffix(registry, ".gcr.io") {
+		return "", "", nil
+	}
+	source, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return "", "", err
+	}
+	token, err := source.Token()
+	if err != nil {
+		return "", "", err
+	}
+	return "oauth2accesstoken", token.AccessToken, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func Test_ParseImage(t *testing.T) {
+	require.Equal(t, imageRef{registry: "registry-1.docker.io", repository: "library/alpine", tag: "latest"}, parseImage("alpine"))
+	require.Equal(t, imageRef{registry: "registry-1.docker.io", repository: "dbt-labs/dbt-core", tag: "1.7"}, parseImage("dbt-labs/dbt-core:1.7"))
+	require.Equal(t, imageRef{registry: "localhost:5000", repository: "jobs/export", tag: "latest"}, parseImage("localhost:5000/jobs/export"))
+	require.Equal(t, imageRef{registry: "europe-docker.pkg.dev", repository: "p/r/export", tag: "v1"}, parseImage("europe-docker.pkg.dev/p/r/export:v1"))
+	require.Equal(t, imageRef{registry: "europe-docker.pkg.dev", repository: "p/r/export", digest: testDigest}, parseImage("europe-docker.pkg.dev/p/r/export@"+testDigest))
+}
+
+func Test_ResolveDigests(t *testing.T) {
+	var requests int
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		require.Equal(t, http.MethodHead, r.Method)
+		require.Contains(t, r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json")
+		switch r.URL.Path {
+		case "/v2/jobs/export/manifests/latest", "/v2/jobs/export/manifests/v1":
+			w.Header().Set("Docker-Content-Digest", testDigest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	r := newDigestResolver()
+	jobs, err := r.resolveDigests(context.Background(), []job{
+		{Name: "latest", Image: host + "/jobs/export"},
+		{Name: "tagged", Image: host + "/jobs/export:v1"},
+		{Name: "again", Image: host + "/jobs/export:v1"},
+		{Name: "pinned", Image: host + "/jobs/export@" + testDigest},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, requests)
+	for _, j := range jobs {
+		require.Equal(t, host+"/jobs/export@"+testDigest, j.Image)
+	}
+	require.Equal(t, host+"/jobs/export", jobs[0].imageTag)
+	require.Equal(t, host+"/jobs/export:v1", jobs[1].imageTag)
+	require.Empty(t, jobs[3].imageTag)
+
+	runJob := createRunJobFromJob(convertToRunJob("runner@test", jobs[1]))
+	require.Equal(t, host+"/jobs/export:v1", runJob.Annotations[imageTagAnnotation])
+
+	_, err = r.resolveDigests(context.Background(), []job{
+		{Name: "missing", Image: host + "/jobs/import:v1", pos: position{File: "jobs.yml", Line: 2, Column: 5}},
+	})
+	require.EqualError(t, err, `jobs.yml:2:5: job "missing": could not resolve image `+host+`/jobs/import:v1: tag v1 does not exist`)
+}
+
+func Test_ResolveDigests_BearerToken(t *testing.T) {
+	mux := http.NewServeMux()
+	registry := httptest.NewServer(mux)
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "registry.test", r.URL.Query().Get("service"))
+		require.Equal(t, "repository:jobs/export:pull", r.URL.Query().Get("scope"))
+		user, password, _ := r.BasicAuth()
+		require.Equal(t, "oauth2accesstoken", user)
+		require.Equal(t, "adc", password)
+		_, _ = w.Write([]byte(`{"token": "pull"}`))
+	})
+	mux.HandleFunc("/v2/jobs/export/manifests/v1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer pull" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+registry.URL+`/token",service="registry.test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", testDigest)
+	})
+
+	r := newDigestResolver()
+	r.token = func(_ context.Context, _ string) (string, string, error) {
+		return "oauth2accesstoken", "adc", nil
+	}
+	jobs, err := r.resolveDigests(context.Background(), []job{{Name: "export", Image: host + "/jobs/export:v1"}})
+	require.NoError(t, err)
+	require.Equal(t, host+"/jobs/export@"+testDigest, jobs[0].Image)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type envGroup struct {
+	vars    []envVar
+	origins map[string]origin
+	pos     position
+}
+
+// envFileSource is the origin of the env vars read from an env_file. Their
+// values are literal and are not interpolated.
+const envFileSource = "env file"
+
+// envGroupSet holds the env groups of all loaded files by name.
+type envGroupSet map[string]envGroup
+
+// collectEnvGroups gathers the env groups of files, reporting groups that are
+// defined more than once.
+func collectEnvGroups(files []*jobFile, marks origins) (envGroupSet, error) {
+	groups := envGroupSet{}
+	var errs errorList
+	for _, f := range files {
+		n := mappingValue(f.body, "env_groups")
+		if n == nil {
+			continue
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			pos := position{File: f.path, Line: key.Line, Column: key.Column}
+			if first, ok := groups[key.Value]; ok {
+				errs = append(errs, positionError{pos, fmt.Sprintf("duplicate env group %q, first defined at %s", key.Value, first.pos)})
+				continue
+			}
+			groups[key.Value] = envGroup{
+				vars:    f.root.EnvGroups[key.Value],
+				origins: marks.fieldOrigins(removeDeleted(n.Content[i+1])),
+				pos:     pos,
+			}
+		}
+	}
+	return groups, errs.err()
+}
+
+// resolveEnv merges the env file and the env groups of j under its own env.
+// The job's env takes precedence over the groups, which take precedence over
+// the env file. Groups defining the same variable differently conflict.
+func (groups envGroupSet) resolveEnv(j job) (job, error) {
+	if j.EnvFile == "" && len(j.EnvGroups) == 0 {
+		return j, nil
+	}
+
+	var errs errorList
+	var env []envVar
+	origins := map[string]origin{}
+	set := func(e envVar, o map[string]origin, prefix string) {
+		if i := pie.FindFirstUsing(env, func(v envVar) bool { return v.Name == e.Name }); i >= 0 {
+			env[i] = e
+		} else {
+			env = append(env, e)
+		}
+		for _, field := range []string{"value", "secret", "secret_version"} {
+			path := fmt.Sprintf("env[%s].%s", e.Name, field)
+			delete(origins, path)
+			if orig, ok := o[fmt.Sprintf("%s[%s].%s", prefix, e.Name, field)]; ok {
+				origins[path] = orig
+			}
+		}
+	}
+
+	if j.EnvFile != "" {
+		file := j.EnvFile
+		if o, ok := j.origins["env_file"]; ok && !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(o.Pos.File), file)
+		}
+		vars, lines, err := readEnvFile(file)
+		if _, ok := err.(errorList); !ok && err != nil {
+			err = positionError{j.pos, fmt.Sprintf("job %q: %s", j.Name, err)}
+		}
+		errs.add(err)
+		for i, e := range vars {
+			set(e, map[string]origin{fmt.Sprintf("[%s].value", e.Name): {Source: envFileSource, Pos: position{File: file, Line: lines[i], Column: 1}}}, "")
+		}
+	}
+
+	definedBy := map[string]string{}
+	for _, name := range j.EnvGroups {
+		g, ok := groups[name]
+		if !ok {
+			known := pie.Sort(pie.Keys(groups))
+			if len(known) == 0 {
+				errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: unknown env group %q, no env groups are defined", j.Name, name)})
+			} else {
+				errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: unknown env group %q, known env groups: %s", j.Name, name, strings.Join(known, ", "))})
+			}
+			continue
+		}
+		for _, e := range g.vars {
+			if other, ok := definedBy[e.Name]; ok {
+				first := env[pie.FindFirstUsing(env, func(v envVar) bool { return v.Name == e.Name })]
+				if first != e {
+					errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: env %q is defined differently by env groups %s and %s", j.Name, e.Name, other, name)})
+				}
+				continue
+			}
+			definedBy[e.Name] = name
+			set(e, g.origins, "")
+		}
+	}
+
+	own := map[string]bool{}
+	for _, e := range j.Env {
+		if own[e.Name] {
+			// Keep duplicates of the job itself for validateEnv to report.
+			env = append(env, e)
+			continue
+		}
+		own[e.Name] = true
+		set(e, j.origins, "env")
+	}
+
+	j.Env = env
+	j.EnvFile = ""
+	j.EnvGroups = nil
+	j.origins = mergeOrigins(j.origins, origins)
+	return j, errs.err()
+}
+
+// mergeOrigins returns the origins of a job with the env origins replaced by
+// envOrigins.
+func mergeOrigins(jobOrigins, envOrigins map[string]origin) map[string]origin {
+	merged := map[string]origin{}
+	for path, o := range jobOrigins {
+		if !strings.HasPrefix(path, "env[") && path != "env_file" && !strings.HasPrefix(path, "env_groups[") {
+			merged[path] = o
+		}
+	}
+	for path, o := range envOrigins {
+		merged[path] = o
+	}
+	return merged
+}
+
+// readEnvFile parses a dotenv file into literal env vars and the line each of
+// them is defined on. It accepts blank lines, # comments, an optional export
+// prefix and single or double quoted values. Variables defined more than once
+// with different values are reported.
+func readEnvFile(file string) ([]envVar, []int, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, errors.Errorf("could not read env file %s", file)
+	}
+
+	var vars []envVar
+	var lines []int
+	var errs errorList
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		pos := position{File: file, Line: line, Column: 1}
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+		name, value, ok := strings.Cut(text, "=")
+		if !ok {
+			errs = append(errs, positionError{pos, "expected NAME=value"})
+			continue
+		}
+		name = strings.TrimSpace(name)
+		value, err = envFileValue(strings.TrimSpace(value))
+		if err != nil {
+			errs = append(errs, positionError{pos, err.Error()})
+			continue
+		}
+
+		if i := pie.FindFirstUsing(vars, func(v envVar) bool { return v.Name == name }); i >= 0 {
+			if vars[i].Value != value {
+				errs = append(errs, positionError{pos, fmt.Sprintf("%s is defined differently on line %d", name, lines[i])})
+			}
+			continue
+		}
+		vars = append(vars, envVar{Name: name, Value: value})
+		lines = append(lines, line)
+	}
+	return vars, lines, errs.err()
+}
+
+func envFileValue(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := strings.LastIndex(s, `"`)
+		if end == 0 {
+			return "", errors.New("unterminated double quoted value")
+		}
+		return strconv.Unquote(s[:end+1])
+	case strings.HasPrefix(s, "'"):
+		end := strings.LastIndex(s, "'")
+		if end == 0 {
+			return "", errors.New("unterminated single quoted value")
+		}
+		return s[1:end], nil
+	default:
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = strings.TrimSpace(s[:i])
+		}
+		return s, nil
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ReadJobsEnvGroups(t *testing.T) {
+	jobs, err := readJobs("data/env/jobs.yml")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(jobs))
+
+	j := jobs[0]
+	require.Equal(t, []envVar{
+		{Name: "APP_NAME", Value: "exporter"},
+		{Name: "LOG_LEVEL", Value: "debug"},
+		{Name: "GREETING", Value: "hello\nworld"},
+		{Name: "RAW", Value: "single quoted # kept"},
+		{Name: "DB_HOST", Value: "db.internal"},
+		{Name: "DB_PASSWORD", Secret: "db-password"},
+	}, j.Env)
+	require.Empty(t, j.EnvGroups)
+	require.Empty(t, j.EnvFile)
+	require.Equal(t, "env file (data/env/app.env:2:1)", j.origins["env[APP_NAME].value"].String())
+	require.Equal(t, "env group db (data/env/jobs.yml:4:14)", j.origins["env[DB_HOST].value"].String())
+	require.Equal(t, "env group db (data/env/jobs.yml:6:15)", j.origins["env[DB_PASSWORD].secret"].String())
+	require.Equal(t, "job (data/env/jobs.yml:20:16)", j.origins["env[LOG_LEVEL].value"].String())
+
+	require.Nil(t, jobs[1].Env)
+}
+
+func Test_InterpolateEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.env"), []byte("PASS=a$$b\nTPL=${x}\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "jobs.yml"), []byte("jobs:\n  - name: export\n    image: exporter\n    env_file: app.env\n    env:\n      - name: HOME_DIR\n        value: $${HOME}\n"), 0o600))
+
+	jobs, err := readJobs(filepath.Join(dir, "jobs.yml"))
+	require.NoError(t, err)
+	jobs, err = interpolateJobs(args{}, jobs)
+	require.NoError(t, err)
+	require.Equal(t, []envVar{
+		{Name: "PASS", Value: "a$$b"},
+		{Name: "TPL", Value: "${x}"},
+		{Name: "HOME_DIR", Value: "${HOME}"},
+	}, jobs[0].Env)
+}
+
+func Test_ReadJobsEnvGroupsConflict(t *testing.T) {
+	_, err := readJobs("data/env/conflict.yml")
+	require.EqualError(t, err, "data/env/conflict.yml:9:5: job \"conflict\": env \"DB_HOST\" is defined differently by env groups a and b\n"+
+		"data/env/conflict.yml:9:5: job \"conflict\": unknown env group \"c\", known env groups: a, b")
+}
+
+func Test_ReadEnvFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.env")
+	require.NoError(t, os.WriteFile(file, []byte("A=1\nA=2\nB\nC=\"open\n"), 0o600))
+	_, _, err := readEnvFile(file)
+	require.EqualError(t, err, file+":2:1: A is defined differently on line 1\n"+
+		file+":3:1: expected NAME=value\n"+
+		file+":4:1: unterminated double quoted value")
+}
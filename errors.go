@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// position locates a node in a jobs.yml file.
+type position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p position) String() string {
+	if p.Line == 0 {
+		return p.File
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// positionError is an error tied to a location in a jobs.yml file.
+type positionError struct {
+	Pos position
+	Msg string
+}
+
+func (e positionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// errorList collects several errors so that they can be reported together
+// instead of stopping at the first one.
+type errorList []error
+
+func (l errorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// add appends err to the list, or the errors it holds when it is an errorList.
+// A nil err is ignored.
+func (l *errorList) add(err error) {
+	if list, ok := err.(errorList); ok {
+		*l = append(*l, list...)
+	} else if err != nil {
+		*l = append(*l, err)
+	}
+}
+
+// err returns the list as an error, or nil when it is empty.
+func (l errorList) err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
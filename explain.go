@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// redacted replaces secret values in the output.
+const redacted = "(redacted)"
+
+// builtinOrigins describes where the values of fields that are not set in
+// the jobs files come from. Other fields fall back to the built-in defaults.
+var builtinOrigins = map[string]string{
+	"service_account": "--service-account or the default compute account",
+}
+
+// renderJobs prints the jobs as they will be deployed, after merging,
+// interpolation and defaults. The proto format prints the Cloud Run job and
+// the Cloud Scheduler job sent to the APIs.
+func renderJobs(args args, format string) error {
+	args = withDefaultAccounts(args)
+	jobs, err := loadJobs(args)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "yaml":
+		var docs []interface{}
+		for _, j := range jobs {
+			n, err := jobNode(j)
+			if err != nil {
+				return err
+			}
+			docs = append(docs, n)
+		}
+		return yaml.NewEncoder(os.Stdout).Encode(docs)
+	case "json":
+		var docs []interface{}
+		for _, j := range jobs {
+			n, err := jobNode(j)
+			if err != nil {
+				return err
+			}
+			var doc interface{}
+			err = n.Decode(&doc)
+			if err != nil {
+				return err
+			}
+			docs = append(docs, doc)
+		}
+		return printJson(docs)
+	case "proto":
+		svc := &service{
+			project:               args.ProjectId,
+			region:                args.Region,
+			defaultServiceAccount: args.ServiceAccount,
+			defaultTriggerAccount: args.TriggerAccount,
+		}
+		var docs []map[string]json.RawMessage
+		for _, j := range jobs {
+			runJob := createRunJobFromJob(j)
+			runJob.Name = svc.parent() + "/jobs/" + j.Name
+			doc := map[string]json.RawMessage{}
+			doc["job"], err = protojson.Marshal(runJob)
+			if err != nil {
+				return err
+			}
+			if j.Schedule != "" {
+				doc["trigger"], err = protojson.Marshal(svc.newSchedulerJob(j))
+				if err != nil {
+					return err
+				}
+			}
+			docs = append(docs, doc)
+		}
+		return printJson(docs)
+	default:
+		return errors.Errorf("unknown format %q, expected yaml, json or proto", format)
+	}
+}
+
+func printJson(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// explain prints every field of the job name with its value and where the
+// value comes from.
+func explain(args args, name string) error {
+	args = withDefaultAccounts(args)
+	jobs, err := loadJobs(args)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range jobs {
+		if j.Name != name {
+			continue
+		}
+		fields, err := explainJob(j)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("job %s [%s]\n", j.Name, j.pos)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, f := range fields {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", f.path, f.value, f.origin)
+		}
+		return w.Flush()
+	}
+	return errors.Errorf("unknown job %s", name)
+}
+
+type explainedField struct {
+	path   string
+	value  string
+	origin string
+}
+
+// explainJob returns the fields of j that have a value together with their
+// provenance: the file default, template, overlay or job that sets them, the
+// variables interpolated into them, or the built-in default.
+func explainJob(j job) ([]explainedField, error) {
+	n, err := jobNode(j)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []explainedField
+	var collect func(n *yaml.Node, path string)
+	collect = func(n *yaml.Node, path string) {
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				// The names of list items are part of their path.
+				if n.Content[i].Value == "name" && strings.HasSuffix(path, "]") {
+					continue
+				}
+				collect(n.Content[i+1], joinPath(path, n.Content[i].Value))
+			}
+		case yaml.SequenceNode:
+			named := namedItems(n)
+			for i, item := range n.Content {
+				if named {
+					collect(item, fmt.Sprintf("%s[%s]", path, itemName(item)))
+				} else {
+					collect(item, fmt.Sprintf("%s[%d]", path, i))
+				}
+			}
+		case yaml.ScalarNode:
+			fields = append(fields, explainedField{path: path, value: n.Value, origin: fieldOrigin(j, path)})
+		}
+	}
+	collect(n, "")
+	return fields, nil
+}
+
+func fieldOrigin(j job, path string) string {
+	var origin string
+	switch o, ok := j.origins[path]; {
+	case ok:
+		origin = o.String()
+	case path == "name":
+		origin = "job"
+	case builtinOrigins[path] != "":
+		origin = builtinOrigins[path]
+	default:
+		origin = "built-in default"
+	}
+	if sources := j.varSources[path]; len(sources) > 0 {
+		origin += ", via " + strings.Join(sources, ", ")
+	}
+	return origin
+}
+
+// jobNode returns j as a yaml mapping without the fields that are not set.
+// Values read from Secret Manager are redacted.
+func jobNode(j job) (*yaml.Node, error) {
+	env := make([]envVar, len(j.Env))
+	for i, e := range j.Env {
+		if e.sensitive {
+			e.Value = redacted
+		}
+		env[i] = e
+	}
+	j.Env = env
+
+	var n yaml.Node
+	err := n.Encode(j)
+	if err != nil {
+		return nil, err
+	}
+	pruneEmpty(&n)
+	return &n, nil
+}
+
+// pruneEmpty removes the null values, empty strings and empty collections
+// below n and reports whether n itself is empty.
+func pruneEmpty(n *yaml.Node) bool {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return n.Tag == "!!null" || (n.Tag == "!!str" && n.Value == "")
+	case yaml.MappingNode:
+		content := n.Content[:0]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if !pruneEmpty(n.Content[i+1]) {
+				content = append(content, n.Content[i], n.Content[i+1])
+			}
+		}
+		n.Content = content
+	case yaml.SequenceNode:
+		content := n.Content[:0]
+		for _, item := range n.Content {
+			if !pruneEmpty(item) {
+				content = append(content, item)
+			}
+		}
+		n.Content = content
+	}
+	return len(n.Content) == 0
+}
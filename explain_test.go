@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_ExplainJob(t *testing.T) {
+	jobs, err := readJobsWith(readOptions{Env: "production"}, "data/overlays")
+	require.NoError(t, err)
+	jobs[0].Image = "${registry}/exporter"
+	jobs, err = interpolateJobs(args{Vars: []string{"registry=europe-docker.pkg.dev/test"}}, jobs)
+	require.NoError(t, err)
+	j := convertToRunJob("sa@test", jobs[0])
+
+	fields, err := explainJob(j)
+	require.NoError(t, err)
+	origins := map[string]string{}
+	values := map[string]string{}
+	for _, f := range fields {
+		origins[f.path] = f.origin
+		values[f.path] = f.value
+	}
+
+	require.NotContains(t, origins, "env[LOG_LEVEL].name")
+	require.NotContains(t, origins, "args")
+	require.Equal(t, "europe-docker.pkg.dev/test/exporter", values["image"])
+	require.Equal(t, "job (data/overlays/jobs.yml:7:12), via --var registry", origins["image"])
+	require.Equal(t, "overlay production (data/overlays/jobs.production.yml:3:15)", origins["schedule"])
+	require.Equal(t, "file default (data/overlays/jobs.yml:4:11)", origins["labels.team"])
+	require.Equal(t, "512Mi", values["memory"])
+	require.Equal(t, "built-in default", origins["memory"])
+	require.Equal(t, "15m0s", values["timeout"])
+	require.Equal(t, "--service-account or the default compute account", origins["service_account"])
+}
+
+func Test_JobNode(t *testing.T) {
+	n, err := jobNode(job{Name: "test", Retries: ptr(0), Labels: map[string]string{}, BinaryAuthorization: &binaryAuthorization{UseDefault: true}})
+	require.NoError(t, err)
+
+	var out map[string]interface{}
+	require.NoError(t, n.Decode(&out))
+	require.Equal(t, map[string]interface{}{
+		"name":                 "test",
+		"retries":              0,
+		"binary_authorization": map[string]interface{}{"use_default": true},
+	}, out)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// jobKeyOrder is the canonical order of the keys of a job. The keys of the
+// other types follow the order of the fields of their Go type.
+var jobKeyOrder = []string{
+	"name", "description", "extends", "matrix",
+	"registry", "image", "args",
+	"schedule", "timezone", "trigger",
+	"service_account", "roles",
+	"cpu", "memory", "tasks", "parallelism", "retries", "timeout",
+	"env_groups", "env_file", "env", "env_from_secret",
+	"labels",
+	"execution_environment", "launch_stage", "encryption_key", "binary_authorization", "image_policy_exemption",
+}
+
+// formatFiles rewrites the jobs files matched by paths, and their overlays, in
+// the canonical format. With check it only lists the files that are not
+// formatted and fails if there are any.
+func formatFiles(paths []string, check bool) error {
+	files, err := expandPaths(paths, "", "")
+	if err != nil {
+		return err
+	}
+	files, err = withOverlayFiles(files)
+	if err != nil {
+		return err
+	}
+
+	var unformatted []string
+	for _, file := range files {
+		if isTemplateFile(file) {
+			log.Warn().Msgf("skipping %s, templates are not formatted", file)
+			continue
+		}
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "could not read %s", file)
+		}
+		formatted, err := formatJobsFile(src)
+		if err != nil {
+			return errors.Wrapf(err, "could not format %s", file)
+		}
+		if bytes.Equal(src, formatted) {
+			continue
+		}
+		unformatted = append(unformatted, file)
+		fmt.Println(file)
+		if check {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(file, formatted, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+	if check && len(unformatted) > 0 {
+		return cli.Exit(fmt.Sprintf("%d files are not formatted, run gruns fmt", len(unformatted)), 1)
+	}
+	return nil
+}
+
+// withOverlayFiles adds the overlays next to files that were not matched.
+func withOverlayFiles(files []string) ([]string, error) {
+	var all []string
+	add := func(file string) {
+		if !pie.Contains(all, file) {
+			all = append(all, file)
+		}
+	}
+	for _, file := range files {
+		add(file)
+		ext := filepath.Ext(file)
+		overlays, err := filepath.Glob(strings.TrimSuffix(file, ext) + ".*" + ext)
+		if err != nil {
+			return nil, err
+		}
+		for _, overlay := range overlays {
+			env := strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(overlay, ext)), ".")
+			if overlayPath(file, env) == overlay {
+				add(overlay)
+			}
+		}
+	}
+	return all, nil
+}
+
+// formatJobsFile returns src in the canonical format: keys in canonical order,
+// two spaces of indentation and strings quoted only when they have to be, with
+// double quotes. Comments are kept with the nodes they belong to. Files without
+// any document, such as empty or comments-only files, are returned unchanged.
+// Mappings holding an anchor and an alias to it keep their order, so that the
+// alias stays below its anchor, and the result is checked to load as src.
+func formatJobsFile(src []byte) ([]byte, error) {
+	var out bytes.Buffer
+	docs := 0
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	dec := yaml.NewDecoder(bytes.NewReader(src))
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs++
+		formatNode(&doc, reflect.TypeOf(root{}))
+		err = enc.Encode(&doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if docs == 0 {
+		return src, nil
+	}
+	err := enc.Close()
+	if err != nil {
+		return nil, err
+	}
+	formatted := separateSections(out.Bytes())
+
+	before, err := decodeDocuments(src)
+	if err != nil {
+		return nil, err
+	}
+	after, err := decodeDocuments(formatted)
+	if err != nil || !reflect.DeepEqual(before, after) {
+		return nil, errors.New("formatting would change the content of the file, check the anchors and aliases")
+	}
+	return formatted, nil
+}
+
+// decodeDocuments returns the values of the documents of src, with aliases
+// and merge keys resolved.
+func decodeDocuments(src []byte) ([]interface{}, error) {
+	var docs []interface{}
+	dec := yaml.NewDecoder(bytes.NewReader(src))
+	for {
+		var doc interface{}
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// separateSections puts a blank line before every top-level key but the first
+// of a document, above the comments of the key.
+func separateSections(src []byte) []byte {
+	lines := strings.SplitAfter(string(src), "\n")
+	var out []string
+	start := 0
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "---"):
+			out = append(out, lines[start:i+1]...)
+			start = i + 1
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "-") || strings.TrimSpace(line) == "":
+			continue
+		default:
+			// Keep the comments above the key with it.
+			head := i
+			for head > start && strings.HasPrefix(lines[head-1], "#") {
+				head--
+			}
+			out = append(out, lines[start:head]...)
+			if len(out) > 0 && !strings.HasPrefix(out[len(out)-1], "---") && strings.TrimSpace(out[len(out)-1]) != "" {
+				out = append(out, "\n")
+			}
+			start = head
+		}
+	}
+	out = append(out, lines[start:]...)
+	return []byte(strings.Join(out, ""))
+}
+
+// formatNode canonicalizes n, which holds a value of type t, and its children.
+// t is nil for values that are not part of the model.
+func formatNode(n *yaml.Node, t reflect.Type) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			formatNode(c, t)
+		}
+	case yaml.MappingNode:
+		n.Style &^= yaml.FlowStyle
+		var fields map[string]reflect.StructField
+		if t != nil && t.Kind() == reflect.Struct {
+			fields = yamlFields(t)
+			if !holdsAliasedAnchor(n) {
+				sortKeys(n, keyRank(t, fields))
+			}
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Tag == "!!merge" {
+				// The encoder writes the tag of merge keys, !!merge <<,
+				// unless it is left to be resolved.
+				n.Content[i].Tag = ""
+			}
+			formatNode(n.Content[i], nil)
+			var valueType reflect.Type
+			switch {
+			case fields != nil:
+				if f, ok := fields[n.Content[i].Value]; ok {
+					valueType = f.Type
+				}
+			case t != nil && t.Kind() == reflect.Map:
+				valueType = t.Elem()
+			}
+			formatNode(n.Content[i+1], valueType)
+		}
+	case yaml.SequenceNode:
+		n.Style &^= yaml.FlowStyle
+		var itemType reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			itemType = t.Elem()
+		}
+		for _, c := range n.Content {
+			formatNode(c, itemType)
+		}
+	case yaml.ScalarNode:
+		formatScalar(n)
+	}
+}
+
+// keyRank returns the position of the keys of t in the canonical order.
+func keyRank(t reflect.Type, fields map[string]reflect.StructField) func(key string) int {
+	if t == reflect.TypeOf(job{}) || t == reflect.TypeOf(jobDefaults{}) || t == reflect.TypeOf(jobTemplate{}) {
+		return func(key string) int {
+			for i, k := range jobKeyOrder {
+				if k == key {
+					return i
+				}
+			}
+			return len(jobKeyOrder)
+		}
+	}
+	return func(key string) int {
+		if f, ok := fields[key]; ok {
+			return f.Index[0]
+		}
+		return t.NumField()
+	}
+}
+
+// holdsAliasedAnchor reports whether an anchor below n is referenced by an
+// alias below n, which reordering n could move above the anchor.
+func holdsAliasedAnchor(n *yaml.Node) bool {
+	anchors := map[*yaml.Node]bool{}
+	var aliases []*yaml.Node
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		if n.Anchor != "" {
+			anchors[n] = true
+		}
+		if n.Kind == yaml.AliasNode {
+			aliases = append(aliases, n.Alias)
+		}
+		for _, c := range n.Content {
+			walk(c)
+		}
+	}
+	walk(n)
+	return pie.Any(aliases, func(a *yaml.Node) bool { return anchors[a] })
+}
+
+// sortKeys orders the pairs of the mapping n by rank. Merge keys come first
+// and unknown keys last, in their original order.
+func sortKeys(n *yaml.Node, rank func(key string) int) {
+	type pair struct{ key, value *yaml.Node }
+	pairs := make([]pair, 0, len(n.Content)/2)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		pairs = append(pairs, pair{n.Content[i], n.Content[i+1]})
+	}
+	order := func(p pair) int {
+		if p.key.Tag == "!!merge" {
+			return -1
+		}
+		return rank(p.key.Value)
+	}
+	sort.SliceStable(pairs, func(a, b int) bool { return order(pairs[a]) < order(pairs[b]) })
+	n.Content = n.Content[:0]
+	for _, p := range pairs {
+		n.Content = append(n.Content, p.key, p.value)
+	}
+}
+
+// formatScalar writes strings plain when that keeps their value and in double
+// quotes otherwise. Block scalars are left alone.
+func formatScalar(n *yaml.Node) {
+	if n.Tag != "!!str" || n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		return
+	}
+	n.Style = 0
+	out, err := yaml.Marshal(&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: n.Value})
+	if err == nil && (bytes.HasPrefix(out, []byte("'")) || bytes.HasPrefix(out, []byte(`"`))) {
+		n.Style = yaml.DoubleQuotedStyle
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_FormatJobsFile(t *testing.T) {
+	src, err := os.ReadFile("data/fmt/jobs.yml")
+	require.NoError(t, err)
+	want, err := os.ReadFile("data/fmt/jobs.formatted.yml")
+	require.NoError(t, err)
+
+	got, err := formatJobsFile(src)
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(got))
+
+	again, err := formatJobsFile(got)
+	require.NoError(t, err)
+	require.Equal(t, string(got), string(again))
+
+	// Formatting keeps the jobs as they are.
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "jobs.yml"), got, 0644))
+	formatted, err := readJobs(filepath.Join(dir, "jobs.yml"))
+	require.NoError(t, err)
+	original, err := readJobs("data/fmt/jobs.yml")
+	require.NoError(t, err)
+	for i := range original {
+		original[i].pos, formatted[i].pos = position{}, position{}
+		original[i].origins, formatted[i].origins = nil, nil
+	}
+	require.Equal(t, original, formatted)
+
+	// Files without documents are left alone.
+	for _, src := range []string{"", "\n", "# jobs are added per team\n# see the wiki\n"} {
+		got, err := formatJobsFile([]byte(src))
+		require.NoError(t, err)
+		require.Equal(t, src, string(got))
+	}
+}
+
+func Test_FormatJobsFile_Aliases(t *testing.T) {
+	src := `templates:
+  base: &base
+    memory: 1Gi
+defaults:
+  <<: *base
+  retries: 1
+jobs:
+  - name: export
+    timeout: &n 3
+    retries: *n
+    image: exporter
+  - retries: 2
+    name: import
+`
+	got, err := formatJobsFile([]byte(src))
+	require.NoError(t, err)
+	require.Equal(t, `templates:
+  base: &base
+    memory: 1Gi
+
+defaults:
+  <<: *base
+  retries: 1
+
+jobs:
+  - name: export
+    timeout: &n 3
+    retries: *n
+    image: exporter
+  - name: import
+    retries: 2
+`, string(got))
+
+	before, err := decodeDocuments([]byte(src))
+	require.NoError(t, err)
+	after, err := decodeDocuments(got)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func Test_FormatFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "jobs.yml")
+	overlay := filepath.Join(dir, "jobs.production.yml")
+	require.NoError(t, os.WriteFile(base, []byte("jobs:\n  - name: export\n    image: exporter\n"), 0644))
+	require.NoError(t, os.WriteFile(overlay, []byte("jobs:\n- memory: 2Gi\n  name: export\n"), 0644))
+
+	require.Error(t, formatFiles([]string{dir}, true))
+	b, err := os.ReadFile(overlay)
+	require.NoError(t, err)
+	require.Equal(t, "jobs:\n- memory: 2Gi\n  name: export\n", string(b))
+
+	require.NoError(t, formatFiles([]string{dir}, false))
+	b, err = os.ReadFile(overlay)
+	require.NoError(t, err)
+	require.Equal(t, "jobs:\n  - name: export\n    memory: 2Gi\n", string(b))
+	require.NoError(t, formatFiles([]string{dir}, true))
+}
+
+func Test_FormatFiles_KeepsMode(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "jobs.yml")
+	require.NoError(t, os.WriteFile(file, []byte("jobs:\n- name: export\n  image: exporter\n"), 0600))
+
+	require.NoError(t, formatFiles([]string{file}, false))
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"cloud.google.com/go/run/apiv2/runpb"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// iamBindingsAnnotation records on a run job the IAM bindings gruns added for
+// it, so that they can be removed once no job needs them anymore.
+const iamBindingsAnnotation = "gruns-cli/iam-bindings"
+
+const runInvokerRole = "roles/run.invoker"
+const secretAccessorRole = "roles/secretmanager.secretAccessor"
+
+// secretAccessRoles are the roles that allow reading the payload of a secret.
+var secretAccessRoles = []string{secretAccessorRole, "roles/secretmanager.admin", "roles/owner"}
+
+// iamBinding grants role to member on resource.
+type iamBinding struct {
+	Resource string `json:"resource"`
+	Role     string `json:"role"`
+	Member   string `json:"member"`
+}
+
+func (b iamBinding) String() string {
+	return fmt.Sprintf("%s to %s on %s", b.Role, b.Member, b.Resource)
+}
+
+// jobBindings returns the bindings j needs: roles/run.invoker on the job for
+// the account of its trigger, and roles/secretmanager.secretAccessor on the
+// secrets of the project referenced by its env and its declared roles on the
+// project for its service account, or the --service-account when it has none.
+// Access to the secrets of other projects is left to their owners.
+func (c *service) jobBindings(j job) []iamBinding {
+	var bindings []iamBinding
+	add := func(b iamBinding) {
+		if !pie.Contains(bindings, b) {
+			bindings = append(bindings, b)
+		}
+	}
+	if j.Schedule != "" {
+		add(iamBinding{Resource: c.parent() + "/jobs/" + j.Name, Role: runInvokerRole, Member: "serviceAccount:" + c.triggerAccount(j)})
+	}
+	account := c.jobAccount(j)
+	if account == "" {
+		return bindings
+	}
+	member := "serviceAccount:" + account
+	for _, e := range j.Env {
+		if e.Secret != "" && strings.HasPrefix(secretName(c.project, e.Secret), "projects/"+c.project+"/") {
+			add(iamBinding{Resource: secretName(c.project, e.Secret), Role: secretAccessorRole, Member: member})
+		}
+	}
+	for _, role := range j.Roles {
+		add(iamBinding{Resource: "projects/" + c.project, Role: role, Member: member})
+	}
+	return bindings
+}
+
+// iamPlan holds the changes to the IAM policies the jobs need.
+type iamPlan struct {
+	add    []iamBinding
+	remove []iamBinding
+	// records holds by job name the bindings gruns added for the job.
+	records map[string][]iamBinding
+}
+
+func (p iamPlan) changes() []string {
+	var changes []string
+	for _, b := range p.add {
+		changes = append(changes, fmt.Sprintf("+ iam %s", b))
+	}
+	for _, b := range p.remove {
+		changes = append(changes, fmt.Sprintf("- iam %s", b))
+	}
+	return changes
+}
+
+// planIam compares the bindings the jobs and the service accounts need with
+// the IAM policies. Missing bindings are added, bindings that already exist
+// are left alone. Every job records the bindings gruns added that it needs.
+// Recorded bindings, including those of jobs that are pruned, are removed once
+// no job needs them anymore, except on the run jobs that are deleted anyway.
+// The project roles of the owned service accounts that are not needed are
+// removed whoever granted them.
+func (c *service) planIam(ctx context.Context, jobs []job, accounts []serviceAccount, owned []string, recorded map[string][]iamBinding) (iamPlan, error) {
+	policies := map[string]*iampb.Policy{}
+	policy := func(resource string) (*iampb.Policy, error) {
+		if p, ok := policies[resource]; ok {
+			return p, nil
+		}
+		p, err := c.getIamPolicy(ctx, resource)
+		if err != nil {
+			return nil, err
+		}
+		policies[resource] = p
+		return p, nil
+	}
+
+	wasRecorded := map[iamBinding]bool{}
+	for _, bindings := range recorded {
+		for _, b := range bindings {
+			wasRecorded[b] = true
+		}
+	}
+
+	plan := iamPlan{records: map[string][]iamBinding{}}
+	needed := map[iamBinding]bool{}
+	jobResources := map[string]bool{}
+	for _, j := range jobs {
+		jobResources[c.parent()+"/jobs/"+j.Name] = true
+		for _, b := range c.jobBindings(j) {
+			needed[b] = true
+			granted, err := c.grants(b, policy)
+			if err != nil {
+				return iamPlan{}, err
+			}
+			switch {
+			case pie.Contains(plan.add, b):
+				plan.records[j.Name] = append(plan.records[j.Name], b)
+			case !granted:
+				plan.add = append(plan.add, b)
+				plan.records[j.Name] = append(plan.records[j.Name], b)
+			case wasRecorded[b]:
+				plan.records[j.Name] = append(plan.records[j.Name], b)
+			}
+		}
+	}
+
+	project := "projects/" + c.project
+	for _, a := range accounts {
+		for _, role := range a.Roles {
+			b := iamBinding{Resource: project, Role: role, Member: "serviceAccount:" + serviceAccountEmail(c.project, a.Name)}
+			needed[b] = true
+			granted, err := c.grants(b, policy)
+			if err != nil {
+				return iamPlan{}, err
+			}
+			if !granted && !pie.Contains(plan.add, b) {
+				plan.add = append(plan.add, b)
+			}
+		}
+	}
+
+	for _, name := range pie.Sort(pie.Keys(recorded)) {
+		for _, b := range recorded[name] {
+			if needed[b] || pie.Contains(plan.remove, b) {
+				continue
+			}
+			if strings.Contains(b.Resource, "/jobs/") && !jobResources[b.Resource] {
+				continue
+			}
+			p, err := policy(b.Resource)
+			if err != nil {
+				return iamPlan{}, err
+			}
+			if grantsRole(p, b.Member, []string{b.Role}) {
+				plan.remove = append(plan.remove, b)
+			}
+		}
+	}
+
+	if len(owned) > 0 {
+		p, err := policy(project)
+		if err != nil {
+			return iamPlan{}, err
+		}
+		for _, binding := range p.GetBindings() {
+			if binding.Condition != nil {
+				continue
+			}
+			for _, member := range binding.Members {
+				b := iamBinding{Resource: project, Role: binding.Role, Member: member}
+				if pie.Contains(owned, member) && !needed[b] && !pie.Contains(plan.remove, b) {
+					plan.remove = append(plan.remove, b)
+				}
+			}
+		}
+	}
+	return plan, nil
+}
+
+// grants reports whether the policies already grant b. Access to a secret is
+// also granted by the other roles that allow reading it, on the secret or on
+// its project.
+func (c *service) grants(b iamBinding, policy func(resource string) (*iampb.Policy, error)) (bool, error) {
+	roles := []string{b.Role}
+	resources := []string{b.Resource}
+	if b.Role == secretAccessorRole {
+		project, _, _ := strings.Cut(b.Resource, "/secrets/")
+		roles = secretAccessRoles
+		resources = append(resources, project)
+	}
+	for _, resource := range resources {
+		p, err := policy(resource)
+		if err != nil {
+			return false, err
+		}
+		if grantsRole(p, b.Member, roles) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// applyIam adds and removes the bindings of plan, updating the policy of every
+// resource once.
+func (c *service) applyIam(ctx context.Context, plan iamPlan) error {
+	var resources []string
+	for _, b := range append(plan.add[:len(plan.add):len(plan.add)], plan.remove...) {
+		if !pie.Contains(resources, b.Resource) {
+			resources = append(resources, b.Resource)
+		}
+	}
+
+	for _, resource := range resources {
+		policy, err := c.getIamPolicy(ctx, resource)
+		if err != nil {
+			return err
+		}
+		for _, b := range plan.add {
+			if b.Resource == resource {
+				addBinding(policy, b)
+			}
+		}
+		for _, b := range plan.remove {
+			if b.Resource == resource {
+				removeBinding(policy, b)
+			}
+		}
+		_, err = c.iamClient(resource).SetIamPolicy(ctx, &iampb.SetIamPolicyRequest{Resource: resource, Policy: policy})
+		if err != nil {
+			return err
+		}
+		log.Debug().Msgf("updated the IAM policy of %s", resource)
+	}
+	return nil
+}
+
+// getIamPolicy returns the policy of resource. Resources that do not exist yet
+// have an empty policy.
+func (c *service) getIamPolicy(ctx context.Context, resource string) (*iampb.Policy, error) {
+	policy, err := c.iamClient(resource).GetIamPolicy(ctx, &iampb.GetIamPolicyRequest{
+		Resource: resource,
+		Options:  &iampb.GetPolicyOptions{RequestedPolicyVersion: 3},
+	})
+	if status.Code(err) == codes.NotFound {
+		return &iampb.Policy{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get the IAM policy of %s", resource)
+	}
+	return policy, nil
+}
+
+func (c *service) iamClient(resource string) iamPolicyClient {
+	switch {
+	case strings.Contains(resource, "/jobs/"):
+		return c.jobPolicies
+	case strings.Contains(resource, "/secrets/"):
+		return c.secrets
+	default:
+		return c.projects
+	}
+}
+
+// grantsRole reports whether policy binds member to one of roles without a
+// condition.
+func grantsRole(policy *iampb.Policy, member string, roles []string) bool {
+	for _, b := range policy.GetBindings() {
+		if b.Condition == nil && pie.Contains(roles, b.Role) && pie.Contains(b.Members, member) {
+			return true
+		}
+	}
+	return false
+}
+
+func addBinding(policy *iampb.Policy, b iamBinding) {
+	for _, binding := range policy.Bindings {
+		if binding.Role == b.Role && binding.Condition == nil {
+			if !pie.Contains(binding.Members, b.Member) {
+				binding.Members = append(binding.Members, b.Member)
+			}
+			return
+		}
+	}
+	policy.Bindings = append(policy.Bindings, &iampb.Binding{Role: b.Role, Members: []string{b.Member}})
+}
+
+func removeBinding(policy *iampb.Policy, b iamBinding) {
+	var bindings []*iampb.Binding
+	for _, binding := range policy.Bindings {
+		if binding.Role == b.Role && binding.Condition == nil {
+			binding.Members = pie.Filter(binding.Members, func(m string) bool { return m != b.Member })
+			if len(binding.Members) == 0 {
+				continue
+			}
+		}
+		bindings = append(bindings, binding)
+	}
+	policy.Bindings = bindings
+}
+
+// recordedBindings returns by job name the bindings recorded on the run jobs
+// managed by gruns.
+func recordedBindings(c *service) (map[string][]iamBinding, error) {
+	ctx := context.Background()
+	iterJobs := c.jobclient.ListJobs(ctx, &runpb.ListJobsRequest{Parent: c.parent(), PageSize: 500})
+
+	recorded := map[string][]iamBinding{}
+	for {
+		res, err := iterJobs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if res.Labels["managed_by"] != tag {
+			continue
+		}
+		bindings, err := parseIamBindings(res.Annotations[iamBindingsAnnotation])
+		if err != nil {
+			return nil, errors.Wrapf(err, "job %s: invalid %s annotation", res.Name, iamBindingsAnnotation)
+		}
+		recorded[trimParent(c.parent(), res.Name)] = bindings
+	}
+	return recorded, nil
+}
+
+func parseIamBindings(annotation string) ([]iamBinding, error) {
+	if annotation == "" {
+		return nil, nil
+	}
+	var bindings []iamBinding
+	err := json.Unmarshal([]byte(annotation), &bindings)
+	return bindings, err
+}
+
+// iamBindingsValue returns the annotation recording bindings.
+func iamBindingsValue(bindings []iamBinding) string {
+	if len(bindings) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(bindings)
+	return string(b)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_Iam(t *testing.T) {
+	secrets := newFakeSecretManager()
+	projects := fakePolicies{}
+	jobPolicies := fakePolicies{}
+	svc := &service{
+		project:               "test",
+		region:                "europe-west1",
+		secrets:               secrets,
+		projects:              projects,
+		jobPolicies:           jobPolicies,
+		defaultTriggerAccount: "trigger@test",
+	}
+	ctx := context.Background()
+
+	projects.grant("projects/shared", "roles/secretmanager.admin", "serviceAccount:runner@test")
+	projects.grant("projects/test", "roles/storage.admin", "serviceAccount:runner@test")
+	projects.grant("projects/test", "roles/pubsub.publisher", "serviceAccount:old@test")
+	projects.grant("projects/test", "roles/logging.logWriter", "serviceAccount:runner@test")
+
+	jobs := []job{{
+		Name:           "export",
+		ServiceAccount: "runner@test",
+		Schedule:       "0 * * * *",
+		Roles:          []string{"roles/bigquery.dataEditor", "roles/logging.logWriter"},
+		Env: []envVar{
+			{Name: "DB_PASSWORD", Secret: "db-password"},
+			{Name: "API_KEY", Secret: "projects/shared/secrets/api-key"},
+		},
+	}}
+	recorded := map[string][]iamBinding{
+		"export": {{Resource: "projects/test", Role: "roles/storage.admin", Member: "serviceAccount:runner@test"}},
+		"old": {
+			{Resource: "projects/test", Role: "roles/pubsub.publisher", Member: "serviceAccount:old@test"},
+			{Resource: "projects/test/locations/europe-west1/jobs/old", Role: runInvokerRole, Member: "serviceAccount:trigger@test"},
+		},
+	}
+
+	plan, err := svc.planIam(ctx, jobs, nil, nil, recorded)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"+ iam roles/run.invoker to serviceAccount:trigger@test on projects/test/locations/europe-west1/jobs/export",
+		"+ iam roles/secretmanager.secretAccessor to serviceAccount:runner@test on projects/test/secrets/db-password",
+		"+ iam roles/bigquery.dataEditor to serviceAccount:runner@test on projects/test",
+		"- iam roles/storage.admin to serviceAccount:runner@test on projects/test",
+		"- iam roles/pubsub.publisher to serviceAccount:old@test on projects/test",
+	}, plan.changes())
+	require.Equal(t, plan.add, plan.records["export"])
+
+	require.NoError(t, svc.applyIam(ctx, plan))
+	require.True(t, grantsRole(jobPolicies["projects/test/locations/europe-west1/jobs/export"], "serviceAccount:trigger@test", []string{runInvokerRole}))
+	require.True(t, grantsRole(secrets.policies["projects/test/secrets/db-password"], "serviceAccount:runner@test", []string{secretAccessorRole}))
+	require.True(t, grantsRole(projects["projects/test"], "serviceAccount:runner@test", []string{"roles/bigquery.dataEditor"}))
+	require.True(t, grantsRole(projects["projects/test"], "serviceAccount:runner@test", []string{"roles/logging.logWriter"}))
+	require.False(t, grantsRole(projects["projects/test"], "serviceAccount:runner@test", []string{"roles/storage.admin"}))
+	require.False(t, grantsRole(projects["projects/test"], "serviceAccount:old@test", []string{"roles/pubsub.publisher"}))
+
+	// Once applied nothing changes and the job keeps its record.
+	again, err := svc.planIam(ctx, jobs, nil, nil, plan.records)
+	require.NoError(t, err)
+	require.Empty(t, again.changes())
+	require.Equal(t, plan.records, again.records)
+
+	// Bindings gruns added are removed with the last job needing them, the
+	// bindings that existed before are kept.
+	again, err = svc.planIam(ctx, nil, nil, nil, plan.records)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"- iam roles/secretmanager.secretAccessor to serviceAccount:runner@test on projects/test/secrets/db-password",
+		"- iam roles/bigquery.dataEditor to serviceAccount:runner@test on projects/test",
+	}, again.changes())
+}
+
+func Test_IamBindingsAnnotation(t *testing.T) {
+	bindings := []iamBinding{{Resource: "projects/test", Role: "roles/bigquery.dataEditor", Member: "serviceAccount:runner@test"}}
+	value := iamBindingsValue(bindings)
+	parsed, err := parseIamBindings(value)
+	require.NoError(t, err)
+	require.Equal(t, bindings, parsed)
+
+	j := convertToRunJob("runner@test", job{Name: "export", Image: "export", iamBindings: bindings})
+	runJob := createRunJobFromJob(j)
+	require.Equal(t, value, runJob.Annotations[iamBindingsAnnotation])
+	require.Empty(t, updateJob(runJob, j))
+
+	j.iamBindings = nil
+	require.Equal(t, []string{"annotations"}, updateJob(runJob, j))
+	require.NotContains(t, runJob.Annotations, iamBindingsAnnotation)
+}
+
+func Test_Iam_DefaultServiceAccount(t *testing.T) {
+	svc := &service{project: "test", region: "europe-west1", defaultServiceAccount: "runner@test"}
+	j := job{
+		Name:  "export",
+		Roles: []string{"roles/bigquery.dataEditor"},
+		Env:   []envVar{{Name: "DB_PASSWORD", Secret: "db-password"}},
+	}
+	require.Equal(t, []iamBinding{
+		{Resource: "projects/test/secrets/db-password", Role: secretAccessorRole, Member: "serviceAccount:runner@test"},
+		{Resource: "projects/test", Role: "roles/bigquery.dataEditor", Member: "serviceAccount:runner@test"},
+	}, svc.jobBindings(j))
+
+	svc.defaultServiceAccount = ""
+	require.Empty(t, svc.jobBindings(j))
+}
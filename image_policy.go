@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/pkg/errors"
+	"reflect"
+	"strings"
+)
+
+// The rules of the image policy a job can be exempted from.
+const (
+	imageRuleRegistry = "registry"
+	imageRuleLatest   = "latest"
+	imageRuleDigest   = "digest"
+)
+
+var imageRules = []string{imageRuleRegistry, imageRuleLatest, imageRuleDigest}
+
+// collectImagePolicy returns the image policy of files. The policy applies to
+// the jobs of every file and may be declared once.
+func collectImagePolicy(files []*jobFile) (*imagePolicy, error) {
+	var policy *imagePolicy
+	var errs errorList
+	for _, f := range files {
+		n := mappingValue(f.body, "image_policy")
+		if n == nil || isDeleted(n) {
+			continue
+		}
+		pos := position{File: f.path, Line: n.Line, Column: n.Column}
+		if policy != nil {
+			errs = append(errs, positionError{pos, fmt.Sprintf("duplicate image_policy, first defined at %s", policy.pos)})
+			continue
+		}
+		policy = &imagePolicy{}
+		err := removeDeleted(n).Decode(policy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not unmarshal %s", f.path)
+		}
+		policy.pos = pos
+		policy.vars = f.root.Vars
+	}
+	return policy, errs.err()
+}
+
+// interpolateImagePolicy resolves the placeholders of policy like those of the
+// jobs, so that registries can be written as ${REGION}-docker.pkg.dev/...
+func interpolateImagePolicy(args args, policy *imagePolicy) (*imagePolicy, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	in, err := newInterpolator(args)
+	if err != nil {
+		return nil, err
+	}
+	var errs errorList
+	interpolated := *policy
+	interpolateValue(reflect.ValueOf(&interpolated).Elem(), "", func(path, s string) string {
+		expanded, err := in.expand(s, policy.vars, nil)
+		if err != nil {
+			errs = append(errs, positionError{Pos: policy.pos, Msg: fmt.Sprintf("image_policy: %s: %s", path, err)})
+			return s
+		}
+		return expanded
+	})
+	return &interpolated, errs.err()
+}
+
+// checkImagePolicy checks the image of every job against policy and reports
+// every violation at once. Jobs are exempted from the rules listed in their
+// image_policy_exemption. With resolveDigests the tags are pinned to their
+// digest before deploying, which satisfies the digest rule.
+func checkImagePolicy(policy *imagePolicy, jobs []job, resolveDigests bool) error {
+	if policy == nil {
+		return nil
+	}
+	var errs errorList
+	for _, j := range jobs {
+		for _, v := range policy.violations(j.Image) {
+			if j.ImagePolicyExemption != nil && pie.Contains(j.ImagePolicyExemption.Rules, v.rule) {
+				continue
+			}
+			if resolveDigests && v.rule == imageRuleDigest {
+				continue
+			}
+			errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: image %s %s (image_policy at %s)", j.Name, j.Image, v.msg, policy.pos)})
+		}
+	}
+	return errs.err()
+}
+
+// imageViolation is a rule of the image policy an image breaks.
+type imageViolation struct {
+	rule string
+	msg  string
+}
+
+func (p *imagePolicy) violations(image string) []imageViolation {
+	var violations []imageViolation
+	ref := parseImage(image)
+	if len(p.AllowedRegistries) > 0 && !pie.Any(p.AllowedRegistries, func(prefix string) bool { return inRegistry(image, prefix) }) {
+		violations = append(violations, imageViolation{imageRuleRegistry, fmt.Sprintf("is not in an allowed registry (%s)", strings.Join(p.AllowedRegistries, ", "))})
+	}
+	if p.ForbidLatest && ref.digest == "" && ref.tag == "latest" {
+		violations = append(violations, imageViolation{imageRuleLatest, "uses the latest tag, use a version tag or a digest"})
+	}
+	if p.RequireDigest && ref.digest == "" {
+		violations = append(violations, imageViolation{imageRuleDigest, "is not pinned by digest, use <image>@sha256:<digest>"})
+	}
+	return violations
+}
+
+// inRegistry reports whether image is in the registry or repository prefix.
+// Images without a registry are on docker.io.
+func inRegistry(image, prefix string) bool {
+	name := image
+	if !hasRegistry(image) {
+		name = "docker.io/" + image
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	return strings.HasPrefix(name, prefix+"/")
+}
+
+// validateImagePolicyExemption requires exemptions to name known rules and to
+// give the reason for them.
+func validateImagePolicyExemption(e *imagePolicyExemption) errorList {
+	if e == nil {
+		return nil
+	}
+	var errs errorList
+	if len(e.Rules) == 0 {
+		errs = append(errs, errors.New("image_policy_exemption: rules cannot be empty"))
+	}
+	for _, rule := range e.Rules {
+		if !pie.Contains(imageRules, rule) {
+			errs = append(errs, errors.Errorf("image_policy_exemption: unknown rule %q, must be one of %s", rule, strings.Join(imageRules, ", ")))
+		}
+	}
+	if strings.TrimSpace(e.Reason) == "" {
+		errs = append(errs, errors.New("image_policy_exemption: reason cannot be empty"))
+	}
+	return errs
+}
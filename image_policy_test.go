@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_ImagePolicy(t *testing.T) {
+	a := args{ProjectId: "test", FileNames: []string{"data/image_policy/jobs.yml"}}
+	_, err := loadConfig(a)
+	require.EqualError(t, err, `data/image_policy/jobs.yml:16:5: job "sandbox": image europe-docker.pkg.dev/other/jobs/sandbox:latest is not in an allowed registry (europe-docker.pkg.dev/test/jobs) (image_policy at data/image_policy/jobs.yml:2:3)`+"\n"+
+		`data/image_policy/jobs.yml:16:5: job "sandbox": image europe-docker.pkg.dev/other/jobs/sandbox:latest uses the latest tag, use a version tag or a digest (image_policy at data/image_policy/jobs.yml:2:3)`)
+
+	a.Env = "production"
+	_, err = loadConfig(a)
+	require.ErrorContains(t, err, `data/image_policy/jobs.yml:6:5: job "export": image europe-docker.pkg.dev/test/jobs/exporter:1.4.2 is not pinned by digest`)
+	require.ErrorContains(t, err, `data/image_policy/jobs.yml:11:5: job "dbt": image ghcr.io/dbt-labs/dbt-bigquery:1.7.4 is not pinned by digest`)
+	require.NotContains(t, err.Error(), `job "cleanup"`)
+	require.NotContains(t, err.Error(), `dbt-bigquery is not in an allowed registry`)
+
+	// Resolving the digests at apply time satisfies the digest rule, not the
+	// others.
+	a.ResolveDigests = true
+	_, err = loadConfig(a)
+	require.NotContains(t, err.Error(), "is not pinned by digest")
+	require.ErrorContains(t, err, `job "sandbox": image europe-docker.pkg.dev/other/jobs/sandbox:latest uses the latest tag`)
+
+	cfg, err := readConfig(readOptions{}, "data/image_policy/jobs.yml")
+	require.NoError(t, err)
+	require.Equal(t, []string{"data/image_policy/jobs.yml:11:5: job dbt is exempted from the image policy rules registry: The dbt image is only published on ghcr.io"}, planWarnings(args{}, cfg.jobs))
+}
+
+func Test_ImagePolicyExemption(t *testing.T) {
+	require.Empty(t, validateImagePolicyExemption(&imagePolicyExemption{Rules: []string{"registry", "digest"}, Reason: "vendor image"}))
+	require.EqualError(t, validateImagePolicyExemption(&imagePolicyExemption{Rules: []string{"tag"}, Reason: " "}),
+		"image_policy_exemption: unknown rule \"tag\", must be one of registry, latest, digest\nimage_policy_exemption: reason cannot be empty")
+}
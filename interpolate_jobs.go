@@ -1,20 +1,390 @@
 package main
 
-import "strings"
+import (
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
 
-func interpolateJobs(args args, jobs []job) []job {
-	for i, j := range jobs {
-		jobs[i].Image = interpolateString(args, j.Image)
-		jobs[i].ServiceAccount = interpolateString(args, j.ServiceAccount)
+// varNameRegex matches the names of variables that can be referenced as
+// ${NAME}.
+var varNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// interpolator resolves the ${...} placeholders of the job definitions:
+//
+//   - ${NAME} is replaced by the --var, the vars of the jobs file or the
+//     built-in variable NAME, in that order,
+//   - ${env:NAME} is replaced by the environment variable NAME,
+//   - ${NAME:-fallback} and ${env:NAME:-fallback} use fallback when the
+//     variable is unset or empty,
+//   - $$ is replaced by a single $.
+//
+// Placeholders that cannot be resolved are errors.
+type interpolator struct {
+	builtins  map[string]string
+	cliVars   map[string]string
+	lookupEnv func(string) (string, bool)
+	// used collects where the resolved variables came from, e.g. --var team.
+	used []string
+}
+
+func newInterpolator(args args) (*interpolator, error) {
+	vars, err := cliVars(args)
+	if err != nil {
+		return nil, err
+	}
+	return &interpolator{
+		builtins: map[string]string{
+			"PROJECT_ID":              args.ProjectId,
+			"PROJECT_NUMBER":          args.ProjectNumber,
+			"REGION":                  args.Region,
+			"SERVICE_ACCOUNT":         args.ServiceAccount,
+			"TRIGGER_SERVICE_ACCOUNT": args.TriggerAccount,
+		},
+		cliVars:   vars,
+		lookupEnv: os.LookupEnv,
+	}, nil
+}
+
+// cliVars returns the variables of the --var-file files followed by the
+// --var flags, later definitions take precedence. Lists and mappings in var
+// files are only available to templates.
+func cliVars(args args) (map[string]string, error) {
+	data, err := templateData(args)
+	if err != nil {
+		return nil, err
 	}
-	return jobs
+	vars := map[string]string{}
+	for name, value := range data {
+		if !varNameRegex.MatchString(name) {
+			return nil, errors.Errorf("invalid variable name %q", name)
+		}
+		switch value.(type) {
+		case []interface{}, map[string]interface{}:
+			continue
+		case nil:
+			vars[name] = ""
+		default:
+			vars[name] = fmt.Sprint(value)
+		}
+	}
+	return vars, nil
 }
 
-func interpolateString(args args, s string) string {
-	s = strings.ReplaceAll(s, "${PROJECT_ID}", args.ProjectId)
-	s = strings.ReplaceAll(s, "${PROJECT_NUMBER}", args.ProjectNumber)
-	s = strings.ReplaceAll(s, "${REGION}", args.Region)
-	s = strings.ReplaceAll(s, "${SERVICE_ACCOUNT}", args.ServiceAccount)
-	s = strings.ReplaceAll(s, "${TRIGGER_SERVICE_ACCOUNT}", args.TriggerAccount)
-	return s
+// interpolateJobs resolves the placeholders of every string field of the jobs
+// and reports all unresolved ones together.
+func interpolateJobs(args args, jobs []job) ([]job, error) {
+	in, err := newInterpolator(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs errorList
+	for i := range jobs {
+		errs = append(errs, in.interpolateJob(&jobs[i])...)
+	}
+	return jobs, errs.err()
+}
+
+func (in *interpolator) interpolateJob(j *job) errorList {
+	var errs errorList
+	j.varSources = map[string][]string{}
+	expand := func(path, s string) string {
+		if o, ok := j.origins[path]; ok && o.Source == envFileSource {
+			return s
+		}
+		in.used = nil
+		expanded, err := in.expand(s, j.vars, nil)
+		if len(in.used) > 0 {
+			j.varSources[path] = pie.Sort(pie.Unique(in.used))
+		}
+		if err != nil {
+			pos := j.pos
+			if o, ok := j.origins[path]; ok {
+				pos = o.Pos
+			}
+			errs = append(errs, positionError{Pos: pos, Msg: fmt.Sprintf("job %s: %s: %s", j.Name, path, err)})
+			return s
+		}
+		return expanded
+	}
+	interpolateValue(reflect.ValueOf(j).Elem(), "", expand)
+	for _, p := range j.placeholders {
+		reported := len(errs)
+		n := &yaml.Node{Kind: yaml.ScalarNode, Value: expand(p.path, p.value)}
+		if len(errs) > reported {
+			continue
+		}
+		field := fieldByPath(reflect.ValueOf(j).Elem(), p.path)
+		err := n.Decode(field.Addr().Interface())
+		if err != nil {
+			pos := j.pos
+			if o, ok := j.origins[p.path]; ok {
+				pos = o.Pos
+			}
+			errs = append(errs, positionError{Pos: pos, Msg: fmt.Sprintf("job %s: %s: %s", j.Name, p.path, placeholderError(field.Type(), n.Value, err))})
+		}
+	}
+	j.placeholders = nil
+	return errs
+}
+
+// placeholderError describes the error decoding value, the interpolated value
+// of a field of type t, without the yaml prefix and the line of the detached
+// node.
+func placeholderError(t reflect.Type, value string, err error) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if _, ok := err.(*yaml.TypeError); ok && t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64 {
+		return fmt.Sprintf("%q is not an integer", value)
+	}
+	msg := err.Error()
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		msg = strings.Join(typeErr.Errors, "; ")
+	}
+	return strings.TrimPrefix(msg, "line 0: ")
+}
+
+// placeholder is an integer or duration field set to a placeholder, which
+// cannot be decoded before it is interpolated.
+type placeholder struct {
+	path  string
+	value string
+}
+
+// takePlaceholders removes from n, which holds a value of type t, the fields
+// set to a placeholder and returns them in document order.
+func takePlaceholders(n *yaml.Node, t reflect.Type, path string) []placeholder {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var placeholders []placeholder
+	switch {
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := yamlFields(t)
+		content := n.Content[:0:0]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if f, ok := fields[key.Value]; ok {
+				if holdsPlaceholder(value, f.Type) {
+					placeholders = append(placeholders, placeholder{joinPath(path, key.Value), value.Value})
+					continue
+				}
+				placeholders = append(placeholders, takePlaceholders(value, f.Type, joinPath(path, key.Value))...)
+			}
+			content = append(content, key, value)
+		}
+		n.Content = content
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			placeholders = append(placeholders, takePlaceholders(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value))...)
+		}
+	case n.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, item := range n.Content {
+			placeholders = append(placeholders, takePlaceholders(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return placeholders
+}
+
+// holdsPlaceholder reports whether n sets a field of the integer type t, or
+// a duration, to a placeholder.
+func holdsPlaceholder(n *yaml.Node, t reflect.Type) bool {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64 && n.Kind == yaml.ScalarNode && strings.Contains(n.Value, "${")
+}
+
+// fieldByPath returns the field of the struct v at path, a dot separated list
+// of yaml keys, allocating the nil pointers on the way.
+func fieldByPath(v reflect.Value, path string) reflect.Value {
+	for _, key := range strings.Split(path, ".") {
+		for v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.FieldByIndex(yamlFields(v.Type())[key].Index)
+	}
+	return v
+}
+
+// interpolateValue applies expand to every string reachable from v. The path
+// passed to expand uses the same notation as the origins of a job.
+func interpolateValue(v reflect.Value, path string, expand func(path, s string) string) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			// Copy the value so that jobs sharing it are not modified.
+			c := reflect.New(v.Elem().Type())
+			c.Elem().Set(v.Elem())
+			interpolateValue(c.Elem(), path, expand)
+			v.Set(c)
+		}
+	case reflect.String:
+		v.SetString(expand(path, v.String()))
+	case reflect.Struct:
+		fields := yamlFields(v.Type())
+		keys := pie.Keys(fields)
+		sort.Slice(keys, func(a, b int) bool {
+			return fields[keys[a]].Index[0] < fields[keys[b]].Index[0]
+		})
+		for _, key := range keys {
+			interpolateValue(v.FieldByIndex(fields[key].Index), joinPath(path, key), expand)
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		for i := 0; i < c.Len(); i++ {
+			interpolateValue(c.Index(i), itemPath(path, c.Index(i), i), expand)
+		}
+		v.Set(c)
+	case reflect.Map:
+		if v.IsNil() || v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := iter.Key().String()
+			c.SetMapIndex(iter.Key(), reflect.ValueOf(expand(joinPath(path, key), iter.Value().String())).Convert(v.Type().Elem()))
+		}
+		v.Set(c)
+	}
+}
+
+// itemPath returns the path of the list item v at index i, using its name
+// for named items such as env.
+func itemPath(path string, v reflect.Value, i int) string {
+	if v.Kind() == reflect.Struct {
+		if name := v.FieldByName("Name"); name.IsValid() && name.Kind() == reflect.String && name.String() != "" {
+			return fmt.Sprintf("%s[%s]", path, name.String())
+		}
+	}
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+// expand resolves the placeholders of s using the file variables vars. seen
+// holds the variables being resolved to detect cycles.
+func (in *interpolator) expand(s string, vars map[string]string, seen []string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i+1 == len(s) {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			s = s[i+2:]
+			continue
+		case '{':
+		default:
+			b.WriteByte('$')
+			s = s[i+1:]
+			continue
+		}
+
+		end := placeholderEnd(s[i:])
+		if end < 0 {
+			return "", errors.Errorf("unterminated placeholder %s", s[i:])
+		}
+		value, err := in.resolve(s[i+2:i+end], vars, seen)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
+
+// placeholderEnd returns the index of the brace closing the placeholder at
+// the start of s, or -1 when there is none.
+func placeholderEnd(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// resolve returns the value of the placeholder expression expr, the text
+// between ${ and }.
+func (in *interpolator) resolve(expr string, vars map[string]string, seen []string) (string, error) {
+	name, fallback, hasFallback := strings.Cut(expr, ":-")
+	env := strings.HasPrefix(name, "env:")
+	if env {
+		name = strings.TrimPrefix(name, "env:")
+	}
+	if !varNameRegex.MatchString(name) {
+		return "", errors.Errorf("invalid placeholder ${%s}", expr)
+	}
+
+	var value string
+	var ok bool
+	switch {
+	case env:
+		value, ok = in.lookupEnv(name)
+		if ok {
+			in.used = append(in.used, "env "+name)
+		}
+	case pie.Contains(seen, name):
+		return "", errors.Errorf("variable cycle: %s -> %s", strings.Join(seen, " -> "), name)
+	default:
+		var source string
+		value, source, ok = in.variable(name, vars)
+		if ok {
+			in.used = append(in.used, source+" "+name)
+			var err error
+			value, err = in.expand(value, vars, append(seen[:len(seen):len(seen)], name))
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if hasFallback && value == "" {
+		return in.expand(fallback, vars, seen)
+	}
+	if !ok {
+		if env {
+			return "", errors.Errorf("unresolved environment variable ${env:%s}", name)
+		}
+		return "", errors.Errorf("unresolved variable ${%s}", name)
+	}
+	return value, nil
+}
+
+// variable returns the value of the variable name and where it is defined.
+func (in *interpolator) variable(name string, vars map[string]string) (string, string, bool) {
+	if value, ok := in.cliVars[name]; ok {
+		return value, "--var", true
+	}
+	if value, ok := vars[name]; ok {
+		return value, "vars", true
+	}
+	value, ok := in.builtins[name]
+	return value, "built-in", ok
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_InterpolateJobs(t *testing.T) {
+	t.Setenv("GRUNS_TEST_BUCKET", "exports")
+	jobs, err := readJobs("data/vars.yml")
+	require.NoError(t, err)
+
+	a := args{ProjectId: "test"}
+	_, err = interpolateJobs(a, jobs)
+	require.EqualError(t, err, "data/vars.yml:17:12: job broken: image: unresolved variable ${missing}\n"+
+		"data/vars.yml:20:16: job broken: env[HOME_DIR].value: unresolved environment variable ${env:GRUNS_TEST_UNSET}")
+
+	jobs, err = interpolateJobs(a, jobs[:1])
+	require.NoError(t, err)
+	j := jobs[0]
+	require.Equal(t, "export-data", j.Name)
+	require.Equal(t, "europe-docker.pkg.dev/test/data/exporter", j.Image)
+	require.Equal(t, "0 3 * * *", j.Schedule)
+	require.Equal(t, "--bucket exports --price $5", j.Args)
+	require.Equal(t, map[string]string{"team": "data"}, j.Labels)
+	require.Equal(t, []envVar{{Name: "LOG_LEVEL", Value: "info"}, {Name: "TOKEN", Secret: "data-token"}}, j.Env)
+}
+
+func Test_InterpolateJobsCliVars(t *testing.T) {
+	t.Setenv("GRUNS_TEST_BUCKET", "exports")
+	jobs, err := readJobs("data/vars.yml")
+	require.NoError(t, err)
+
+	a := args{ProjectId: "test", VarFiles: []string{"data/vars.cli.yml"}, Vars: []string{"SCHEDULE=*/5 * * * *"}}
+	jobs, err = interpolateJobs(a, jobs[:1])
+	require.NoError(t, err)
+	require.Equal(t, "export-platform", jobs[0].Name)
+	require.Equal(t, "europe-docker.pkg.dev/test/platform/exporter", jobs[0].Image)
+	require.Equal(t, "*/5 * * * *", jobs[0].Schedule)
+
+	_, err = interpolateJobs(args{Vars: []string{"SCHEDULE"}}, nil)
+	require.EqualError(t, err, `invalid --var "SCHEDULE", expected name=value`)
+}
+
+func Test_InterpolateJobsNumbers(t *testing.T) {
+	jobs, err := readJobs("data/vars_numbers.yml")
+	require.NoError(t, err)
+	require.Nil(t, jobs[0].Tasks)
+
+	_, err = interpolateJobs(args{}, jobs)
+	require.EqualError(t, err, "data/vars_numbers.yml:17:12: job broken: tasks: unresolved variable ${missing}\n"+
+		"data/vars_numbers.yml:18:18: job broken: parallelism: \"many\" is not an integer\n"+
+		"data/vars_numbers.yml:19:14: job broken: timeout: invalid duration \"forever\", expected seconds or a duration like 90m")
+
+	jobs, err = readJobs("data/vars_numbers.yml")
+	require.NoError(t, err)
+	jobs, err = interpolateJobs(args{Vars: []string{"RETRY_COUNT=3"}}, jobs[:2])
+	require.NoError(t, err)
+	for _, j := range jobs {
+		require.Equal(t, 4, *j.Tasks)
+		require.Equal(t, 2, *j.Retries)
+		require.Equal(t, duration(30*time.Minute), *j.Timeout)
+		require.Equal(t, 3, *j.Trigger.RetryCount)
+	}
+}
+
+func Test_InterpolateString(t *testing.T) {
+	in := &interpolator{
+		builtins:  map[string]string{"PROJECT_ID": "test"},
+		cliVars:   map[string]string{},
+		lookupEnv: func(string) (string, bool) { return "", false },
+	}
+	vars := map[string]string{"a": "${b}", "b": "${a}", "empty": ""}
+
+	tests := []struct {
+		in   string
+		want string
+		err  string
+	}{
+		{in: "plain", want: "plain"},
+		{in: "${PROJECT_ID}-$", want: "test-$"},
+		{in: "$HOME", want: "$HOME"},
+		{in: "$${PROJECT_ID}", want: "${PROJECT_ID}"},
+		{in: "${empty:-fallback}", want: "fallback"},
+		{in: "${unset:-${PROJECT_ID}}", want: "test"},
+		{in: "${env:UNSET:-}", want: ""},
+		{in: "${a}", err: "variable cycle: a -> b -> a"},
+		{in: "${PROJECT_ID", err: "unterminated placeholder ${PROJECT_ID"},
+		{in: "${not valid}", err: "invalid placeholder ${not valid}"},
+	}
+	for _, tt := range tests {
+		got, err := in.expand(tt.in, vars, nil)
+		if tt.err != "" {
+			require.EqualError(t, err, tt.err, tt.in)
+			continue
+		}
+		require.NoError(t, err, tt.in)
+		require.Equal(t, tt.want, got, tt.in)
+	}
+}
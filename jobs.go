@@ -8,6 +8,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"google.golang.org/api/iterator"
 	"google.golang.org/genproto/googleapis/api"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"reflect"
 	"strings"
@@ -52,6 +53,17 @@ func trimParent(parent, s string) string {
 	return strings.TrimPrefix(s, parent+"/jobs/")
 }
 
+var executionEnvironments = map[string]runpb.ExecutionEnvironment{
+	"gen1": runpb.ExecutionEnvironment_EXECUTION_ENVIRONMENT_GEN1,
+	"gen2": runpb.ExecutionEnvironment_EXECUTION_ENVIRONMENT_GEN2,
+}
+
+var launchStages = map[string]api.LaunchStage{
+	"alpha": api.LaunchStage_ALPHA,
+	"beta":  api.LaunchStage_BETA,
+	"ga":    api.LaunchStage_GA,
+}
+
 func convertToRunJob(defaultServiceAccount string, j job) job {
 	if j.Memory == "" {
 		j.Memory = defaultMem
@@ -65,25 +77,75 @@ func convertToRunJob(defaultServiceAccount string, j job) job {
 		j.ServiceAccount = defaultServiceAccount
 	}
 
-	if j.Tasks == 0 {
-		j.Tasks = defaultTasks
+	if j.Tasks == nil {
+		j.Tasks = ptr(defaultTasks)
+	}
+
+	if j.Parallelism == nil {
+		j.Parallelism = ptr(defaultParallelism)
+	}
+
+	if j.Timeout == nil {
+		j.Timeout = ptr(duration(defaultTimeout))
 	}
 
-	if j.Parallelism == 0 {
-		j.Parallelism = defaultParallelism
+	if j.Retries == nil {
+		j.Retries = ptr(defaultRetries)
 	}
 
-	if j.Timeout == 0 {
-		j.Timeout = defaultTimeout
+	if j.Timezone == "" {
+		j.Timezone = defaultTimezone
 	}
 
-	if j.Retries == 0 {
-		j.Retries = defaultRetries
+	if j.Registry != "" && !hasRegistry(j.Image) {
+		j.Image = strings.TrimSuffix(j.Registry, "/") + "/" + j.Image
+	}
+
+	if j.ExecutionEnvironment == "" {
+		j.ExecutionEnvironment = defaultExecutionEnvironment
+	}
+
+	if j.LaunchStage == "" {
+		j.LaunchStage = defaultLaunchStage
 	}
 
 	return j
 }
 
+// hasRegistry reports whether image starts with a registry host, following
+// the rules docker uses to tell a host from a repository path.
+func hasRegistry(image string) bool {
+	first, _, found := strings.Cut(image, "/")
+	return found && (strings.ContainsAny(first, ".:") || first == "localhost")
+}
+
+func jobLabels(j job) map[string]string {
+	labels := map[string]string{"managed_by": tag}
+	for k, v := range j.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// jobAnnotations returns the annotations gruns manages on the run job of j.
+// Empty annotations are left out.
+func jobAnnotations(j job) map[string]string {
+	var annotations map[string]string
+	for key, value := range map[string]string{
+		iamBindingsAnnotation: iamBindingsValue(j.iamBindings),
+		imageTagAnnotation:    j.imageTag,
+	} {
+		if value == "" {
+			continue
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key] = value
+	}
+	return annotations
+}
+
 func createRunJobFromJob(j job) *runpb.Job {
 	/*var args []string
 	if j.Args != "" {
@@ -92,15 +154,16 @@ func createRunJobFromJob(j job) *runpb.Job {
 
 	return &runpb.Job{
 		//Name:        fmt.Sprintf("%s", j.Name),
-		Generation:  0,
-		Labels:      map[string]string{"managed_by": tag},
-		Annotations: nil,
-		LaunchStage: api.LaunchStage_BETA,
+		Generation:          0,
+		Labels:              jobLabels(j),
+		Annotations:         jobAnnotations(j),
+		LaunchStage:         launchStages[strings.ToLower(j.LaunchStage)],
+		BinaryAuthorization: convertBinaryAuthorization(j.BinaryAuthorization),
 		Template: &runpb.ExecutionTemplate{
 			Labels:      nil,
 			Annotations: nil,
-			Parallelism: int32(j.Parallelism),
-			TaskCount:   int32(j.Tasks),
+			Parallelism: int32(*j.Parallelism),
+			TaskCount:   int32(*j.Tasks),
 			Template: &runpb.TaskTemplate{
 				Containers: []*runpb.Container{
 					{
@@ -123,29 +186,36 @@ func createRunJobFromJob(j job) *runpb.Job {
 						StartupProbe:  nil,
 					},
 				},
-				Volumes: nil,
-				Retries: &runpb.TaskTemplate_MaxRetries{MaxRetries: int32(j.Retries)},
-				Timeout: &durationpb.Duration{
-					Seconds: int64(j.Timeout),
-					Nanos:   0,
-				},
+				Volumes:              nil,
+				Retries:              &runpb.TaskTemplate_MaxRetries{MaxRetries: int32(*j.Retries)},
+				Timeout:              durationpb.New(time.Duration(*j.Timeout)),
 				ServiceAccount:       j.ServiceAccount,
-				ExecutionEnvironment: runpb.ExecutionEnvironment_EXECUTION_ENVIRONMENT_GEN2,
-				EncryptionKey:        "",
+				ExecutionEnvironment: executionEnvironments[strings.ToLower(j.ExecutionEnvironment)],
+				EncryptionKey:        j.EncryptionKey,
 			},
 		},
 	}
 }
 
+func convertBinaryAuthorization(b *binaryAuthorization) *runpb.BinaryAuthorization {
+	if b == nil {
+		return nil
+	}
+	ba := &runpb.BinaryAuthorization{BreakglassJustification: b.BreakglassJustification}
+	if b.Policy != "" {
+		ba.BinauthzMethod = &runpb.BinaryAuthorization_Policy{Policy: b.Policy}
+	} else {
+		ba.BinauthzMethod = &runpb.BinaryAuthorization_UseDefault{UseDefault: b.UseDefault}
+	}
+	return ba
+}
+
 func convertEnvVars(envVars []envVar) []*runpb.EnvVar {
 	if len(envVars) == 0 {
 		return nil
 	}
 	var envs []*runpb.EnvVar
 	for _, e := range envVars {
-		if e.Value != "" && e.Secret != "" {
-			log.Fatal().Msgf("env var %s has both value and secret set", e.Name)
-		}
 		if e.Value != "" {
 			envs = append(envs, &runpb.EnvVar{
 				Name:   e.Name,
@@ -170,18 +240,18 @@ func convertEnvVars(envVars []envVar) []*runpb.EnvVar {
 
 func updateJob(runJob *runpb.Job, j job) []string {
 	var fieldMask []string
-	if runJob.Template.TaskCount != int32(j.Tasks) {
-		runJob.Template.TaskCount = int32(j.Tasks)
+	if runJob.Template.TaskCount != int32(*j.Tasks) {
+		runJob.Template.TaskCount = int32(*j.Tasks)
 		fieldMask = append(fieldMask, "template.task_count")
 	}
 
-	if runJob.Template.Parallelism != int32(j.Parallelism) {
-		runJob.Template.Parallelism = int32(j.Parallelism)
+	if runJob.Template.Parallelism != int32(*j.Parallelism) {
+		runJob.Template.Parallelism = int32(*j.Parallelism)
 		fieldMask = append(fieldMask, "template.parallelism")
 	}
 
-	if runJob.Template.Template.Timeout.GetSeconds() != int64(j.Timeout) {
-		runJob.Template.Template.Timeout = durationpb.New(time.Second * time.Duration(j.Timeout))
+	if runJob.Template.Template.Timeout.AsDuration() != time.Duration(*j.Timeout) {
+		runJob.Template.Template.Timeout = durationpb.New(time.Duration(*j.Timeout))
 		fieldMask = append(fieldMask, "template.template.timeout")
 	}
 
@@ -225,11 +295,57 @@ func updateJob(runJob *runpb.Job, j job) []string {
 		fieldMask = append(fieldMask, "template.template.service_account")
 	}
 
-	if runJob.Template.Template.Retries.(*runpb.TaskTemplate_MaxRetries).MaxRetries != int32(j.Retries) {
-		runJob.Template.Template.Retries = &runpb.TaskTemplate_MaxRetries{MaxRetries: int32(j.Retries)}
+	if runJob.Template.Template.GetMaxRetries() != int32(*j.Retries) {
+		runJob.Template.Template.Retries = &runpb.TaskTemplate_MaxRetries{MaxRetries: int32(*j.Retries)}
 		fieldMask = append(fieldMask, "template.template.retries")
 	}
 
+	if runJob.Template.Template.EncryptionKey != j.EncryptionKey {
+		runJob.Template.Template.EncryptionKey = j.EncryptionKey
+		fieldMask = append(fieldMask, "template.template.encryption_key")
+	}
+
+	if env := executionEnvironments[strings.ToLower(j.ExecutionEnvironment)]; runJob.Template.Template.ExecutionEnvironment != env {
+		runJob.Template.Template.ExecutionEnvironment = env
+		fieldMask = append(fieldMask, "template.template.execution_environment")
+	}
+
+	if stage := launchStages[strings.ToLower(j.LaunchStage)]; runJob.LaunchStage != stage {
+		runJob.LaunchStage = stage
+		fieldMask = append(fieldMask, "launch_stage")
+	}
+
+	if labels := jobLabels(j); !reflect.DeepEqual(runJob.Labels, labels) {
+		runJob.Labels = labels
+		fieldMask = append(fieldMask, "labels")
+	}
+
+	if ba := convertBinaryAuthorization(j.BinaryAuthorization); !proto.Equal(runJob.BinaryAuthorization, ba) {
+		runJob.BinaryAuthorization = ba
+		fieldMask = append(fieldMask, "binary_authorization")
+	}
+
+	annotations := jobAnnotations(j)
+	changed := false
+	for _, key := range []string{iamBindingsAnnotation, imageTagAnnotation} {
+		value, ok := annotations[key]
+		if runJob.Annotations[key] == value {
+			continue
+		}
+		if runJob.Annotations == nil {
+			runJob.Annotations = map[string]string{}
+		}
+		if ok {
+			runJob.Annotations[key] = value
+		} else {
+			delete(runJob.Annotations, key)
+		}
+		changed = true
+	}
+	if changed {
+		fieldMask = append(fieldMask, "annotations")
+	}
+
 	return fieldMask
 }
 
@@ -265,6 +381,29 @@ func handleRunJob(c *service, j job) error {
 }
 
 func deleteRunJobs(c *service, validJobNames []string) error {
+	ctx := context.Background()
+	names, err := staleRunJobs(c, validJobNames)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		log.Debug().Msgf("deleting job %s ", name)
+		ops, err := c.jobclient.DeleteJob(ctx, &runpb.DeleteJobRequest{Name: name})
+		if err != nil {
+			return err
+		}
+		_, err = ops.Wait(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleRunJobs returns the resource names of the jobs managed by gruns that are
+// no longer defined in validJobNames.
+func staleRunJobs(c *service, validJobNames []string) ([]string, error) {
 	ctx := context.Background()
 	iterJobs := c.jobclient.ListJobs(ctx, &runpb.ListJobsRequest{
 		Parent:    c.parent(),
@@ -272,26 +411,19 @@ func deleteRunJobs(c *service, validJobNames []string) error {
 		PageToken: "",
 	})
 
+	var names []string
 	for {
 		res, err := iterJobs.Next()
 		if err != nil {
 			if err == iterator.Done {
 				break
 			}
-			return err
+			return nil, err
 		}
 
 		if !pie.Contains(validJobNames, trimParent(c.parent(), res.Name)) && res.Labels["managed_by"] == tag {
-			log.Debug().Msgf("deleting job %s ", res.Name)
-			ops, err := c.jobclient.DeleteJob(ctx, &runpb.DeleteJobRequest{Name: res.Name})
-			if err != nil {
-				return err
-			}
-			res, err = ops.Wait(ctx)
-			if err != nil {
-				return err
-			}
+			names = append(names, res.Name)
 		}
 	}
-	return nil
+	return names, nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"testing"
+	"time"
+)
+
+func Test_ConvertToRunJobDefaults(t *testing.T) {
+	j := convertToRunJob("sa@test", job{Name: "test", Image: "test"})
+	require.Equal(t, defaultTasks, *j.Tasks)
+	require.Equal(t, defaultParallelism, *j.Parallelism)
+	require.Equal(t, defaultRetries, *j.Retries)
+	require.Equal(t, duration(defaultTimeout), *j.Timeout)
+	require.Equal(t, "sa@test", j.ServiceAccount)
+}
+
+func Test_ConvertToRunJobExplicitZero(t *testing.T) {
+	j := convertToRunJob("sa@test", job{Name: "test", Image: "test", Retries: ptr(0)})
+	require.Equal(t, 0, *j.Retries)
+
+	rj := createRunJobFromJob(j)
+	require.Equal(t, int32(0), rj.Template.Template.GetMaxRetries())
+}
+
+func Test_DurationUnmarshal(t *testing.T) {
+	tests := map[string]time.Duration{
+		`900`:    15 * time.Minute,
+		`"900"`:  15 * time.Minute,
+		`90m`:    90 * time.Minute,
+		`1h30m`:  90 * time.Minute,
+		`1m30s`:  90 * time.Second,
+		`0`:      0,
+		`0s`:     0,
+		`2h`:     2 * time.Hour,
+		`45s`:    45 * time.Second,
+		`1h0m0s`: time.Hour,
+	}
+	for in, want := range tests {
+		var d duration
+		require.NoError(t, yaml.Unmarshal([]byte(in), &d), in)
+		require.Equal(t, want, time.Duration(d), in)
+	}
+
+	var d duration
+	require.Error(t, yaml.Unmarshal([]byte(`ten minutes`), &d))
+	require.Error(t, yaml.Unmarshal([]byte(`[1]`), &d))
+}
+
+func Test_BinaryAuthorization(t *testing.T) {
+	j := convertToRunJob("sa@test", job{Name: "test", Image: "test"})
+	rj := createRunJobFromJob(j)
+	require.Nil(t, rj.BinaryAuthorization)
+	require.Empty(t, updateJob(rj, j))
+
+	j.BinaryAuthorization = &binaryAuthorization{Policy: "projects/p/platforms/cloudRun/prod"}
+	require.Equal(t, []string{"binary_authorization"}, updateJob(rj, j))
+	require.Equal(t, "projects/p/platforms/cloudRun/prod", rj.BinaryAuthorization.GetPolicy())
+	require.Empty(t, updateJob(rj, j))
+
+	require.Empty(t, planWarnings(args{}, []job{{Name: "test"}}))
+	require.Len(t, planWarnings(args{Protected: true}, []job{{Name: "test"}}), 1)
+	require.Empty(t, planWarnings(args{Protected: true}, []job{j}))
+}
+
+func Test_HasRegistry(t *testing.T) {
+	require.True(t, hasRegistry("europe-docker.pkg.dev/p/r/image:tag"))
+	require.True(t, hasRegistry("localhost/image"))
+	require.True(t, hasRegistry("localhost:5000/image"))
+	require.False(t, hasRegistry("image:tag"))
+	require.False(t, hasRegistry("library/image"))
+}
+
+func Test_Labels(t *testing.T) {
+	j := convertToRunJob("sa@test", job{Name: "test", Image: "test", Labels: map[string]string{"team": "data"}})
+	rj := createRunJobFromJob(j)
+	require.Equal(t, map[string]string{"managed_by": tag, "team": "data"}, rj.Labels)
+	require.Empty(t, updateJob(rj, j))
+
+	j.Labels["team"] = "platform"
+	require.Equal(t, []string{"labels"}, updateJob(rj, j))
+	require.Equal(t, "platform", rj.Labels["team"])
+}
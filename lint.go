@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lintRule is an offline check of the jobs files. Rules are registered in
+// lintRules.
+type lintRule struct {
+	ID          string
+	Description string
+	// Level is the SARIF level of the findings that do not set their own:
+	// error, warning or note.
+	Level string
+	check func(cfg config, args args) []lintFinding
+}
+
+// lintFinding is a problem found by a rule.
+type lintFinding struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Level   string `json:"level"`
+}
+
+func (f lintFinding) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s (%s)", f.File, f.Line, f.Column, f.Message, f.Rule)
+}
+
+func newFinding(rule string, pos position, format string, a ...interface{}) lintFinding {
+	return lintFinding{Rule: rule, Message: fmt.Sprintf(format, a...), File: pos.File, Line: pos.Line, Column: pos.Column}
+}
+
+// lintRules is the fixed set of rules run by the lint command. It is internal
+// to gruns: adding a rule means adding it here, with a unique ID since the ID
+// is what --disable and gruns:ignore comments refer to.
+var lintRules = []lintRule{
+	{
+		ID:          "unused-template",
+		Description: "Templates that no job or template extends.",
+		Level:       "warning",
+		check:       lintUnusedTemplates,
+	},
+	{
+		ID:          "every-minute-schedule",
+		Description: "Schedules that run the job every minute, like * * * * *.",
+		Level:       "warning",
+		check:       lintEveryMinuteSchedules,
+	},
+	{
+		ID:          "short-timeout",
+		Description: "Timeouts shorter than a minute, which most runs need just to start.",
+		Level:       "warning",
+		check:       lintShortTimeouts,
+	},
+	{
+		ID:          "hardcoded-project",
+		Description: "Values containing the --project-id where ${PROJECT_ID} could be used.",
+		Level:       "warning",
+		check:       lintHardcodedProjects,
+	},
+	{
+		ID:          "secret-in-env",
+		Description: "Literal env values that look like secrets and should come from Secret Manager. Values in a known credential format are errors, values only named like a secret are warnings.",
+		Level:       "error",
+		check:       lintSecretsInEnv,
+	},
+	{
+		ID:          "missing-description",
+		Description: "Jobs without a description.",
+		Level:       "note",
+		check:       lintMissingDescriptions,
+	},
+}
+
+// lintLevels are the rule levels from the least to the most severe.
+var lintLevels = []string{"note", "warning", "error"}
+
+// lintIgnoreRegex matches the comments suppressing findings on their line or
+// on the next line, e.g. # gruns:ignore short-timeout, unused-template.
+var lintIgnoreRegex = regexp.MustCompile(`#\s*gruns:ignore\s+([a-z-]+(\s*,\s*[a-z-]+)*)`)
+
+// lint runs the rules that are not disabled over the jobs files and prints the
+// findings in format. It fails when there are findings of the failOn level or
+// a more severe one, or never when failOn is none.
+func lint(args args, format string, disabled []string, failOn string) error {
+	if failOn != "none" && !pie.Contains(lintLevels, failOn) {
+		return errors.Errorf("unknown level %q, expected note, warning, error or none", failOn)
+	}
+	for _, id := range disabled {
+		if pie.FindFirstUsing(lintRules, func(r lintRule) bool { return r.ID == id }) < 0 {
+			return errors.Errorf("unknown lint rule %q", id)
+		}
+	}
+	data, err := templateData(args)
+	if err != nil {
+		return err
+	}
+	cfg, err := readConfig(readOptions{Env: args.Env, Template: args.Template, Data: data}, args.FileNames...)
+	if err != nil {
+		return err
+	}
+
+	rules := pie.Filter(lintRules, func(r lintRule) bool { return !pie.Contains(disabled, r.ID) })
+	findings, err := runLintRules(rules, cfg, args)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "text":
+		for _, f := range findings {
+			fmt.Println(f)
+		}
+	case "json":
+		if findings == nil {
+			findings = []lintFinding{}
+		}
+		err = printJson(findings)
+	case "sarif":
+		err = printJson(sarifReport(rules, findings))
+	default:
+		return errors.Errorf("unknown format %q, expected text, json or sarif", format)
+	}
+	if err != nil {
+		return err
+	}
+	if lintFails(findings, failOn) {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+// lintFails reports whether any of the findings is at least as severe as
+// failOn.
+func lintFails(findings []lintFinding, failOn string) bool {
+	least := pie.FindFirstUsing(lintLevels, func(l string) bool { return l == failOn })
+	if least < 0 {
+		return false
+	}
+	return pie.Any(findings, func(f lintFinding) bool {
+		return pie.FindFirstUsing(lintLevels, func(l string) bool { return l == f.Level }) >= least
+	})
+}
+
+// runLintRules returns the findings of rules that are not suppressed, sorted by
+// location. The jobs of a matrix share their location and are reported once
+// per rule.
+func runLintRules(rules []lintRule, cfg config, args args) ([]lintFinding, error) {
+	lines := map[string][]string{}
+	suppressed := func(f lintFinding) (bool, error) {
+		if _, ok := lines[f.File]; !ok {
+			b, err := os.ReadFile(f.File)
+			if err != nil {
+				return false, err
+			}
+			lines[f.File] = strings.Split(string(b), "\n")
+		}
+		for _, line := range []int{f.Line, f.Line - 1} {
+			if line < 1 || line > len(lines[f.File]) {
+				continue
+			}
+			text := lines[f.File][line-1]
+			if line != f.Line && !strings.HasPrefix(strings.TrimSpace(text), "#") {
+				continue
+			}
+			if m := lintIgnoreRegex.FindStringSubmatch(text); m != nil {
+				for _, id := range strings.Split(m[1], ",") {
+					if strings.TrimSpace(id) == f.Rule {
+						return true, nil
+					}
+				}
+			}
+		}
+		return false, nil
+	}
+
+	var findings []lintFinding
+	reported := map[string]bool{}
+	for _, r := range rules {
+		for _, f := range r.check(cfg, args) {
+			key := fmt.Sprintf("%s %s:%d:%d", f.Rule, f.File, f.Line, f.Column)
+			if reported[key] {
+				continue
+			}
+			reported[key] = true
+			if f.Level == "" {
+				f.Level = r.Level
+			}
+			ok, err := suppressed(f)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				findings = append(findings, f)
+			}
+		}
+	}
+	sort.SliceStable(findings, func(a, b int) bool {
+		x, y := findings[a], findings[b]
+		if x.File != y.File {
+			return x.File < y.File
+		}
+		if x.Line != y.Line {
+			return x.Line < y.Line
+		}
+		return x.Column < y.Column
+	})
+	return findings, nil
+}
+
+// fieldPos returns the position of the field at path of j, or of j itself.
+func fieldPos(j job, path string) position {
+	if o, ok := j.origins[path]; ok && o.Pos.File != "" {
+		return o.Pos
+	}
+	return j.pos
+}
+
+func lintUnusedTemplates(cfg config, _ args) []lintFinding {
+	extended := map[string]bool{}
+	visit := func(n *yaml.Node) {
+		if extends := mappingValue(n, "extends"); extends != nil {
+			extended[extends.Value] = true
+		}
+	}
+	var findings []lintFinding
+	for _, f := range cfg.files {
+		if jobs := mappingValue(f.body, "jobs"); jobs != nil {
+			for _, n := range jobs.Content {
+				visit(n)
+			}
+		}
+		if templates := mappingValue(f.body, "templates"); templates != nil {
+			for i := 1; i < len(templates.Content); i += 2 {
+				visit(templates.Content[i])
+			}
+		}
+	}
+	for _, f := range cfg.files {
+		templates := mappingValue(f.body, "templates")
+		if templates == nil {
+			continue
+		}
+		for i := 0; i+1 < len(templates.Content); i += 2 {
+			key := templates.Content[i]
+			if !extended[key.Value] {
+				pos := position{File: f.path, Line: key.Line, Column: key.Column}
+				findings = append(findings, newFinding("unused-template", pos, "template %q is not extended by any job or template", key.Value))
+			}
+		}
+	}
+	return findings
+}
+
+func lintEveryMinuteSchedules(cfg config, _ args) []lintFinding {
+	var findings []lintFinding
+	for _, j := range cfg.jobs {
+		if j.Schedule == "" || strings.Contains(j.Schedule, "${") {
+			continue
+		}
+		if interval, err := cronInterval(j.Schedule); err == nil && interval == time.Minute {
+			findings = append(findings, newFinding("every-minute-schedule", fieldPos(j, "schedule"), "job %s: schedule %q runs the job every minute", j.Name, j.Schedule))
+		}
+	}
+	return findings
+}
+
+func lintShortTimeouts(cfg config, _ args) []lintFinding {
+	var findings []lintFinding
+	for _, j := range cfg.jobs {
+		if j.Timeout != nil && time.Duration(*j.Timeout) < time.Minute {
+			findings = append(findings, newFinding("short-timeout", fieldPos(j, "timeout"), "job %s: timeout %s is shorter than a typical run, tasks may be killed before they finish", j.Name, time.Duration(*j.Timeout)))
+		}
+	}
+	return findings
+}
+
+func lintHardcodedProjects(cfg config, args args) []lintFinding {
+	if args.ProjectId == "" {
+		return nil
+	}
+	project := regexp.MustCompile(`(^|[^-a-z0-9])` + regexp.QuoteMeta(args.ProjectId) + `($|[^-a-z0-9])`)
+	var findings []lintFinding
+	for _, j := range cfg.jobs {
+		interpolateValue(reflect.ValueOf(&j).Elem(), "", func(path, s string) string {
+			if project.MatchString(s) {
+				findings = append(findings, newFinding("hardcoded-project", fieldPos(j, path), "job %s: %s: hardcoded project %q, use ${PROJECT_ID}", j.Name, path, args.ProjectId))
+			}
+			return s
+		})
+	}
+	return findings
+}
+
+// secretNameRegex matches the names of env vars that usually hold secrets.
+var secretNameRegex = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|API_?KEY|PRIVATE_KEY|CREDENTIALS)`)
+
+// secretValueRegex matches well-known credential formats.
+var secretValueRegex = regexp.MustCompile(`^(AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|sk_live_[0-9A-Za-z]{24,}|xox[abprs]-[0-9A-Za-z-]{10,}|AIza[0-9A-Za-z_-]{35})$|-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+
+func lintSecretsInEnv(cfg config, _ args) []lintFinding {
+	var findings []lintFinding
+	for _, j := range cfg.jobs {
+		for _, e := range j.Env {
+			if e.Value == "" || e.sensitive {
+				continue
+			}
+			pos := fieldPos(j, fmt.Sprintf("env[%s].value", e.Name))
+			switch {
+			case secretValueRegex.MatchString(e.Value):
+				findings = append(findings, newFinding("secret-in-env", pos, "job %s: env %s looks like a secret, reference it from Secret Manager with secret", j.Name, e.Name))
+			case secretNameRegex.MatchString(e.Name):
+				// The name alone also matches settings like TOKEN_URL.
+				f := newFinding("secret-in-env", pos, "job %s: env %s is named like a secret, reference it from Secret Manager with secret if it holds one", j.Name, e.Name)
+				f.Level = "warning"
+				findings = append(findings, f)
+			}
+		}
+	}
+	return findings
+}
+
+func lintMissingDescriptions(cfg config, _ args) []lintFinding {
+	var findings []lintFinding
+	for _, j := range cfg.jobs {
+		if strings.TrimSpace(j.Description) == "" {
+			findings = append(findings, newFinding("missing-description", j.pos, "job %s has no description", j.Name))
+		}
+	}
+	return findings
+}
+
+// sarifReport returns findings as a SARIF 2.1.0 log, the format GitHub code
+// scanning reads.
+func sarifReport(rules []lintRule, findings []lintFinding) map[string]interface{} {
+	var descriptors []map[string]interface{}
+	for _, r := range rules {
+		descriptors = append(descriptors, map[string]interface{}{
+			"id":                   r.ID,
+			"shortDescription":     map[string]string{"text": r.Description},
+			"defaultConfiguration": map[string]string{"level": r.Level},
+		})
+	}
+	results := []map[string]interface{}{}
+	for _, f := range findings {
+		results = append(results, map[string]interface{}{
+			"ruleId":  f.Rule,
+			"level":   f.Level,
+			"message": map[string]string{"text": f.Message},
+			"locations": []interface{}{map[string]interface{}{
+				"physicalLocation": map[string]interface{}{
+					"artifactLocation": map[string]string{"uri": filepath.ToSlash(f.File)},
+					"region":           map[string]int{"startLine": f.Line, "startColumn": f.Column},
+				},
+			}},
+		})
+	}
+	return map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []interface{}{map[string]interface{}{
+			"tool": map[string]interface{}{
+				"driver": map[string]interface{}{
+					"name":           "gruns",
+					"informationUri": "https://github.com/mscno/gruns",
+					"rules":          descriptors,
+				},
+			},
+			"results": results,
+		}},
+	}
+}
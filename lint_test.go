@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/elliotchance/pie/v2"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_Lint(t *testing.T) {
+	cfg, err := readConfig(readOptions{}, "data/lint/jobs.yml")
+	require.NoError(t, err)
+	findings, err := runLintRules(lintRules, cfg, args{ProjectId: "acme-prod"})
+	require.NoError(t, err)
+
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.String())
+	}
+	require.Equal(t, []string{
+		`data/lint/jobs.yml:4:3: template "legacy" is not extended by any job or template (unused-template)`,
+		`data/lint/jobs.yml:13:12: job export: image: hardcoded project "acme-prod", use ${PROJECT_ID} (hardcoded-project)`,
+		`data/lint/jobs.yml:14:15: job export: schedule "* * * * *" runs the job every minute (every-minute-schedule)`,
+		`data/lint/jobs.yml:15:14: job export: timeout 30s is shorter than a typical run, tasks may be killed before they finish (short-timeout)`,
+		`data/lint/jobs.yml:18:16: job export: env DB_PASSWORD is named like a secret, reference it from Secret Manager with secret if it holds one (secret-in-env)`,
+		`data/lint/jobs.yml:20:16: job export: env GITHUB looks like a secret, reference it from Secret Manager with secret (secret-in-env)`,
+		`data/lint/jobs.yml:23:5: job cleanup has no description (missing-description)`,
+	}, got)
+
+	report := sarifReport(lintRules, findings)
+	run := report["runs"].([]interface{})[0].(map[string]interface{})
+	results := run["results"].([]map[string]interface{})
+	require.Len(t, results, len(findings))
+	require.Equal(t, "secret-in-env", results[4]["ruleId"])
+	require.Equal(t, "warning", results[4]["level"])
+	require.Equal(t, "error", results[5]["level"])
+
+	require.True(t, lintFails(findings, "error"))
+	require.True(t, lintFails(findings, "note"))
+	require.False(t, lintFails(findings, "none"))
+	warnings := pie.Filter(findings, func(f lintFinding) bool { return f.Level != "error" })
+	require.False(t, lintFails(warnings, "error"))
+	require.True(t, lintFails(warnings, "warning"))
+}
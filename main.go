@@ -12,7 +12,8 @@ import (
 )
 
 const (
-	tag = "gruns-cli"
+	tag           = "gruns-cli"
+	triggerSuffix = "-trigger"
 )
 
 const (
@@ -22,8 +23,11 @@ const (
 	defaultCpu                = "1000m"
 	defaultTasks              = 1
 	defaultParallelism        = 1
-	defaultTimeout            = 900
+	defaultTimeout            = 15 * time.Minute
 	defaultRetries            = 1
+
+	defaultExecutionEnvironment = "gen2"
+	defaultLaunchStage          = "beta"
 )
 
 func main() {
@@ -31,66 +35,227 @@ func main() {
 	var projectName string
 	var projectNumber string
 	var disableTriggers bool
-	var fileName string
+	var fileNames cli.StringSlice
 	var serviceAccount string
+	var protected bool
+	var env string
+	var vars cli.StringSlice
+	var varFiles cli.StringSlice
+	var renderTemplates bool
+	var skipSecretCheck bool
+	var resolveDigests bool
+	var policies cli.StringSlice
 
 	consoleWriter := zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.Stamp}
 	logger := zerolog.New(consoleWriter).With().Timestamp().Logger()
 	log.Logger = logger
 
+	flags := []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:        "file",
+			Usage:       "Jobs file, directory or glob pattern such as jobs/**/*.yml, can be repeated",
+			Destination: &fileNames,
+			Value:       cli.NewStringSlice(defaultJobDefinitionsFile),
+		},
+		&cli.StringFlag{
+			Name:        "project-id",
+			Usage:       "GCP Project ID",
+			Destination: &projectName,
+			EnvVars:     []string{"GOOGLE_PROJECT_ID"},
+		},
+		&cli.StringFlag{
+			Name:        "project-number",
+			Usage:       "GCP Project Number",
+			Destination: &projectNumber,
+			EnvVars:     []string{"GOOGLE_PROJECT_NUMBER"},
+		},
+		&cli.StringFlag{
+			Name:        "region",
+			Usage:       "GCP Region",
+			Destination: &region,
+			EnvVars:     []string{"GOOGLE_REGION"},
+		},
+		&cli.StringFlag{
+			Name:        "service-account",
+			Usage:       "Service Account Email",
+			Destination: &serviceAccount,
+			EnvVars:     []string{"GOOGLE_SERVICE_ACCOUNT"},
+		},
+		&cli.BoolFlag{
+			Name:        "disable-triggers",
+			Usage:       "Flag to disable trigger activation",
+			Destination: &disableTriggers,
+		},
+		&cli.BoolFlag{
+			Name:        "protected",
+			Usage:       "Treat the target project as a protected environment",
+			Destination: &protected,
+			EnvVars:     []string{"GRUNS_PROTECTED"},
+		},
+		&cli.StringFlag{
+			Name:        "env",
+			Usage:       "Environment overlay to apply, e.g. production applies jobs.production.yml to jobs.yml",
+			Destination: &env,
+			EnvVars:     []string{"GRUNS_ENV"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "var",
+			Usage:       "Variable referenced as ${NAME} in the jobs files, as name=value, can be repeated",
+			Destination: &vars,
+		},
+		&cli.StringSliceFlag{
+			Name:        "var-file",
+			Usage:       "YAML file of variables referenced as ${NAME} in the jobs files, can be repeated",
+			Destination: &varFiles,
+		},
+		&cli.BoolFlag{
+			Name:        "template",
+			Usage:       "Render every jobs file as a Go template, files ending in .tmpl are always rendered",
+			Destination: &renderTemplates,
+		},
+		&cli.BoolFlag{
+			Name:        "skip-secret-check",
+			Usage:       "Do not verify that the referenced secrets exist and are accessible to the jobs",
+			Destination: &skipSecretCheck,
+		},
+		&cli.BoolFlag{
+			Name:        "resolve-digests",
+			Usage:       "Deploy the image tags as the digests they currently point to, so that a re-pushed tag is redeployed",
+			Destination: &resolveDigests,
+			EnvVars:     []string{"GRUNS_RESOLVE_DIGESTS"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "policy",
+			Usage:       "YAML file of CEL policies every job must satisfy, can be repeated",
+			Destination: &policies,
+			EnvVars:     []string{"GRUNS_POLICY"},
+		},
+	}
+
+	cliArgs := func() args {
+		return args{
+			ProjectId:       projectName,
+			ProjectNumber:   projectNumber,
+			Region:          region,
+			DisableTriggers: disableTriggers,
+			Protected:       protected,
+			FileNames:       fileNames.Value(),
+			Env:             env,
+			Vars:            vars.Value(),
+			VarFiles:        varFiles.Value(),
+			Template:        renderTemplates,
+			SkipSecretCheck: skipSecretCheck,
+			ResolveDigests:  resolveDigests,
+			Policies:        policies.Value(),
+			ServiceAccount:  serviceAccount,
+		}
+	}
+
 	app := &cli.App{
 		Name: "gruns",
 		Commands: []*cli.Command{
 			{
 				Name: "apply",
 				Action: func(cCtx *cli.Context) error {
-					return apply(args{
-						ProjectId:       projectName,
-						ProjectNumber:   projectNumber,
-						Region:          region,
-						DisableTriggers: disableTriggers,
-						FileName:        fileName,
-						ServiceAccount:  serviceAccount,
-					})
+					return apply(cliArgs())
 				},
-				Flags: []cli.Flag{
+				Flags: flags,
+			},
+			{
+				Name:  "plan",
+				Usage: "Show the changes apply would make without making them",
+				Action: func(cCtx *cli.Context) error {
+					return plan(cliArgs())
+				},
+				Flags: flags,
+			},
+			{
+				Name:  "render",
+				Usage: "Print the jobs as they will be deployed",
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.Bool("source") {
+						return renderFiles(cliArgs())
+					}
+					return renderJobs(cliArgs(), cCtx.String("format"))
+				},
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
-						Name:        "file",
-						Usage:       "File Path to jobs.yml file",
-						Destination: &fileName,
-						Value:       defaultJobDefinitionsFile,
+						Name:  "format",
+						Usage: "Output format: yaml, json or proto for the Cloud Run and Cloud Scheduler jobs sent to the APIs",
+						Value: "yaml",
 					},
-					&cli.StringFlag{
-						Name:        "project-id",
-						Usage:       "GCP Project ID",
-						Destination: &projectName,
-						EnvVars:     []string{"GOOGLE_PROJECT_ID"},
+					&cli.BoolFlag{
+						Name:  "source",
+						Usage: "Print the jobs files after rendering the templates among them instead",
 					},
+				}, flags...),
+			},
+			{
+				Name:      "explain",
+				Usage:     "Print every field of a job with its value and where the value comes from",
+				ArgsUsage: "<job>",
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 1 {
+						return errors.New("expected the name of a job")
+					}
+					return explain(cliArgs(), cCtx.Args().First())
+				},
+				Flags: flags,
+			},
+			{
+				Name:  "lint",
+				Usage: "Check the jobs files for common mistakes without contacting Google Cloud",
+				Action: func(cCtx *cli.Context) error {
+					return lint(cliArgs(), cCtx.String("format"), cCtx.StringSlice("disable"), cCtx.String("fail-on"))
+				},
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
-						Name:        "project-number",
-						Usage:       "GCP Project Number",
-						Destination: &projectNumber,
-						EnvVars:     []string{"GOOGLE_PROJECT_NUMBER"},
+						Name:  "format",
+						Usage: "Output format: text, json or sarif for GitHub code scanning",
+						Value: "text",
 					},
-					&cli.StringFlag{
-						Name:        "region",
-						Usage:       "GCP Region",
-						Destination: &region,
-						EnvVars:     []string{"GOOGLE_REGION"},
+					&cli.StringSliceFlag{
+						Name:  "disable",
+						Usage: "Rule to skip, can be repeated. Single findings are suppressed with a # gruns:ignore <rule> comment on their line or the line above",
 					},
 					&cli.StringFlag{
-						Name:        "service-account",
-						Usage:       "Service Account Email",
-						Destination: &region,
-						EnvVars:     []string{"GOOGLE_SERVICE_ACCOUNT"},
+						Name:  "fail-on",
+						Usage: "Exit with 1 when there are findings of this level or a more severe one: note, warning, error or none",
+						Value: "error",
+					},
+				}, flags...),
+			},
+			{
+				Name:      "fmt",
+				Usage:     "Rewrite the jobs files and their overlays in the canonical key order and style, keeping comments",
+				ArgsUsage: "[file...]",
+				Action: func(cCtx *cli.Context) error {
+					paths := cCtx.Args().Slice()
+					if len(paths) == 0 {
+						paths = fileNames.Value()
+					}
+					return formatFiles(paths, cCtx.Bool("check"))
+				},
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:        "file",
+						Usage:       "Jobs file, directory or glob pattern such as jobs/**/*.yml, can be repeated",
+						Destination: &fileNames,
+						Value:       cli.NewStringSlice(defaultJobDefinitionsFile),
 					},
 					&cli.BoolFlag{
-						Name:        "disable-triggers",
-						Usage:       "Flag to disable trigger activation",
-						Destination: &disableTriggers,
+						Name:  "check",
+						Usage: "List the files that are not formatted and fail if there are any, without rewriting them",
 					},
 				},
 			},
+			{
+				Name:  "schema",
+				Usage: "Print the JSON Schema of jobs.yml, e.g. for the yaml-language-server",
+				Action: func(cCtx *cli.Context) error {
+					return printSchema()
+				},
+			},
 		},
 	}
 	if err := app.Run(os.Args); err != nil {
@@ -109,12 +274,7 @@ func mustGetEnv(key string) string {
 }
 
 func apply(args args) error {
-	if args.ServiceAccount == "" {
-		args.ServiceAccount = fmt.Sprintf("%s-compute@developer.gserviceaccount.com", args.ProjectNumber)
-	}
-	if args.TriggerAccount == "" {
-		args.TriggerAccount = fmt.Sprintf("%s-compute@developer.gserviceaccount.com", args.ProjectNumber)
-	}
+	args = withDefaultAccounts(args)
 
 	fmt.Println("serviceAccount: ", args.ServiceAccount)
 	fmt.Println("triggerServiceAccount: ", args.TriggerAccount)
@@ -126,21 +286,65 @@ func apply(args args) error {
 
 	ctx := context.Background()
 	svc := initializeService(ctx, args)
-	jobs, err := readJobs(args.FileName)
+	cfg, err := loadConfig(args)
 	if err != nil {
 		return err
 	}
+	jobs := cfg.jobs
 
-	jobs = interpolateJobs(args, jobs)
+	if args.ResolveDigests {
+		jobs, err = newDigestResolver().resolveDigests(ctx, jobs)
+		if err != nil {
+			return err
+		}
+	}
 
-	for _, j := range jobs {
-		j = convertToRunJob(args.ServiceAccount, j)
+	for _, w := range append(cfg.warnings, planWarnings(args, jobs)...) {
+		log.Warn().Msg(w)
+	}
+
+	synced, err := svc.syncManagedSecrets(ctx, cfg.secrets, false)
+	if err != nil {
+		return err
+	}
+	jobs = svc.pinManagedSecrets(jobs, synced.versions)
+
+	if !args.SkipSecretCheck {
+		err = svc.checkSecrets(ctx, jobs, nil)
 		if err != nil {
-			return errors.Wrapf(err, "invalid job: %s", j.Name)
+			return err
 		}
+	}
+
+	jobs, _, err = svc.expandSecretEnv(ctx, jobs, false)
+	if err != nil {
+		return err
+	}
 
+	accounts, err := svc.planServiceAccounts(ctx, cfg.accounts, jobs)
+	if err != nil {
+		return err
+	}
+	err = svc.createServiceAccounts(ctx, accounts)
+	if err != nil {
+		return err
+	}
+
+	recorded, err := recordedBindings(svc)
+	if err != nil {
+		return errors.Wrapf(err, "list run jobs error")
+	}
+	iam, err := svc.planIam(ctx, jobs, cfg.accounts, accounts.owned, recorded)
+	if err != nil {
+		return err
+	}
+	for i, j := range jobs {
+		jobs[i].iamBindings = iam.records[j.Name]
+	}
+
+	for _, j := range jobs {
 		if j.Schedule != "" {
-			triggerNames = append(triggerNames, j.Name+"-trigger")
+			triggerNames = append(triggerNames, j.Name+triggerSuffix)
 		}
 		jobNames = append(jobNames, j.Name)
 
@@ -159,7 +363,78 @@ func apply(args args) error {
 		}
 	}
 
-	return svc.cleanup(triggerNames, jobNames)
+	err = svc.applyIam(ctx, iam)
+	if err != nil {
+		return errors.Wrapf(err, "iam error")
+	}
+
+	err = svc.cleanup(triggerNames, jobNames)
+	if err != nil {
+		return err
+	}
+	return svc.deleteServiceAccounts(ctx, accounts)
+}
+
+func withDefaultAccounts(args args) args {
+	if args.ServiceAccount == "" {
+		args.ServiceAccount = fmt.Sprintf("%s-compute@developer.gserviceaccount.com", args.ProjectNumber)
+	}
+	if args.TriggerAccount == "" {
+		args.TriggerAccount = fmt.Sprintf("%s-compute@developer.gserviceaccount.com", args.ProjectNumber)
+	}
+	return args
+}
+
+// loadJobs reads the job definitions and resolves them into the jobs that
+// will be deployed.
+func loadJobs(args args) ([]job, error) {
+	cfg, err := loadConfig(args)
+	return cfg.jobs, err
+}
+
+// loadConfig reads the jobs files and resolves their jobs into the jobs that
+// will be deployed.
+func loadConfig(args args) (config, error) {
+	data, err := templateData(args)
+	if err != nil {
+		return config{}, err
+	}
+	cfg, err := readConfig(readOptions{Env: args.Env, Template: args.Template, Data: data}, args.FileNames...)
+	if err != nil {
+		return config{}, err
+	}
+
+	jobs, err := interpolateJobs(args, cfg.jobs)
+	if err != nil {
+		return config{}, err
+	}
+	jobs, err = resolveServiceAccounts(args.ProjectId, cfg.accounts, jobs)
+	if err != nil {
+		return config{}, err
+	}
+	cfg.policy, err = interpolateImagePolicy(args, cfg.policy)
+	if err != nil {
+		return config{}, err
+	}
+
+	for i, j := range jobs {
+		jobs[i] = convertToRunJob(args.ServiceAccount, j)
+	}
+	cfg.jobs = jobs
+
+	var errs errorList
+	errs.add(validateJobs(jobs))
+	errs.add(checkImagePolicy(cfg.policy, jobs, args.ResolveDigests))
+	if errs != nil {
+		return cfg, errs.err()
+	}
+
+	policies, err := readPolicies(args.Policies)
+	if err != nil {
+		return config{}, err
+	}
+	cfg.warnings, err = evaluatePolicies(args, policies, jobs)
+	return cfg, err
 }
 
 func (svc *service) cleanup(triggerNames, jobNames []string) error {
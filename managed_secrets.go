@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"strings"
+)
+
+// collectManagedSecrets gathers the managed secrets of files, resolving their
+// files relative to the jobs file and reporting secrets that are defined more
+// than once.
+func collectManagedSecrets(files []*jobFile) ([]managedSecret, error) {
+	var secrets []managedSecret
+	var errs errorList
+	defined := map[string]position{}
+	for _, f := range files {
+		n := mappingValue(f.body, "secrets")
+		if n == nil {
+			continue
+		}
+		for _, item := range n.Content {
+			if isDeleted(item) {
+				continue
+			}
+			var s managedSecret
+			err := removeDeleted(item).Decode(&s)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not unmarshal %s", f.path)
+			}
+			s.pos = position{File: f.path, Line: item.Line, Column: item.Column}
+			if first, ok := defined[s.Name]; ok {
+				errs = append(errs, positionError{s.pos, fmt.Sprintf("duplicate secret %q, first defined at %s", s.Name, first)})
+				continue
+			}
+			defined[s.Name] = s.pos
+			if !filepath.IsAbs(s.File) {
+				s.File = filepath.Join(filepath.Dir(f.path), s.File)
+			}
+			secrets = append(secrets, s)
+		}
+	}
+	return secrets, errs.err()
+}
+
+// secretSync is the outcome of syncing the managed secrets.
+type secretSync struct {
+	// versions maps the full name of every managed secret to the version
+	// holding the content of its file.
+	versions map[string]string
+	// pending holds the secrets a dry run would create.
+	pending map[string]bool
+	changes []string
+}
+
+// syncManagedSecrets decrypts the files of the managed secrets and makes sure
+// the latest version of every secret holds their content, creating the secret
+// or adding a version only when the content changed. In dry run mode nothing
+// is written. The changes never include the content of the secrets.
+func (c *service) syncManagedSecrets(ctx context.Context, secrets []managedSecret, dryRun bool) (secretSync, error) {
+	result := secretSync{versions: map[string]string{}, pending: map[string]bool{}}
+	var errs errorList
+	decrypted := map[string]*yaml.Node{}
+	for _, s := range secrets {
+		data, ok := decrypted[s.File]
+		if !ok {
+			var err error
+			data, err = decryptSopsFile(s.File)
+			if err != nil {
+				errs = append(errs, positionError{s.pos, fmt.Sprintf("secret %q: %s", s.Name, err)})
+				continue
+			}
+			decrypted[s.File] = data
+		}
+		value, err := managedSecretValue(data, s.Key)
+		if err != nil {
+			errs = append(errs, positionError{s.pos, fmt.Sprintf("secret %q: %s: %s", s.Name, s.File, err)})
+			continue
+		}
+
+		name := secretName(c.project, s.Name)
+		version, change, err := c.syncSecret(ctx, name, nil, value, dryRun)
+		if err != nil {
+			errs = append(errs, positionError{s.pos, fmt.Sprintf("secret %q: %s", s.Name, err)})
+			continue
+		}
+		result.versions[name] = version
+		if change != "" {
+			result.changes = append(result.changes, change)
+		}
+		if dryRun && strings.HasPrefix(change, "+ ") {
+			result.pending[name] = true
+		}
+	}
+	return result, errs.err()
+}
+
+// managedSecretValue returns the content of a managed secret: the value of key
+// in the decrypted document, or the whole document as JSON without a key.
+// Mappings and lists are stored as JSON.
+func managedSecretValue(data *yaml.Node, key string) (string, error) {
+	n := data
+	if key != "" {
+		n = mappingValue(data, key)
+		if n == nil {
+			return "", errors.Errorf("no key %q", key)
+		}
+	}
+	if n.Kind == yaml.ScalarNode {
+		return n.Value, nil
+	}
+	var v interface{}
+	err := n.Decode(&v)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Errorf("key %q cannot be stored as JSON", key)
+	}
+	return string(b), nil
+}
+
+// pinManagedSecrets pins the env vars and env_from_secret entries of the jobs
+// that reference a managed secret without a version to the version holding the
+// content of its file, so that a rotation redeploys the jobs using it.
+func (c *service) pinManagedSecrets(jobs []job, versions map[string]string) []job {
+	for i, j := range jobs {
+		if len(j.Env) > 0 {
+			env := make([]envVar, len(j.Env))
+			for k, e := range j.Env {
+				if version, ok := versions[secretName(c.project, e.Secret)]; ok && e.Secret != "" && e.SecretVersion == "" {
+					e.SecretVersion = version
+				}
+				env[k] = e
+			}
+			jobs[i].Env = env
+		}
+		if len(j.EnvFromSecret) > 0 {
+			from := make([]envFromSecret, len(j.EnvFromSecret))
+			for k, e := range j.EnvFromSecret {
+				if version, ok := versions[secretName(c.project, e.Secret)]; ok && e.SecretVersion == "" {
+					e.SecretVersion = version
+				}
+				from[k] = e
+			}
+			jobs[i].EnvFromSecret = from
+		}
+	}
+	return jobs
+}
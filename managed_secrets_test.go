@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ManagedSecrets(t *testing.T) {
+	useSopsTestKey(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "jobs.yml")
+	require.NoError(t, os.WriteFile(file, []byte(`secrets:
+  - name: db-password
+    file: secrets.enc.yml
+    key: password
+  - name: db
+    file: secrets.enc.yml
+jobs:
+  - name: export
+    image: export
+    env:
+      - name: DB_PASSWORD
+        secret: db-password
+      - name: API_KEY
+        secret: api-key
+    env_from_secret:
+      - secret: db
+`), 0o600))
+	encrypted := filepath.Join(dir, "secrets.enc.yml")
+	copyFile(t, "data/sops/secrets.enc.yml", encrypted)
+
+	cfg, err := readConfig(readOptions{}, file)
+	require.NoError(t, err)
+	require.Equal(t, []managedSecret{
+		{Name: "db-password", File: encrypted, Key: "password", pos: position{File: file, Line: 2, Column: 5}},
+		{Name: "db", File: encrypted, pos: position{File: file, Line: 5, Column: 5}},
+	}, cfg.secrets)
+
+	fake := newFakeSecretManager()
+	fake.put("projects/test/secrets/db", `{"host":"db.internal","password":"old"}`)
+	svc := &service{project: "test", secrets: fake}
+	ctx := context.Background()
+
+	synced, err := svc.syncManagedSecrets(ctx, cfg.secrets, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"+ secret db-password", "~ secret db (new version)"}, synced.changes)
+	require.Equal(t, map[string]bool{"projects/test/secrets/db-password": true}, synced.pending)
+	require.Equal(t, 0, fake.writes)
+
+	synced, err = svc.syncManagedSecrets(ctx, cfg.secrets, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"+ secret db-password", "~ secret db (new version)"}, synced.changes)
+	require.Equal(t, map[string]string{"projects/test/secrets/db-password": "1", "projects/test/secrets/db": "2"}, synced.versions)
+	require.Equal(t, []string{"s3cret"}, fake.versions["projects/test/secrets/db-password"])
+	require.Equal(t, `{"host":"db.internal","password":"s3cret"}`, fake.versions["projects/test/secrets/db"][1])
+
+	jobs := svc.pinManagedSecrets(cfg.jobs, synced.versions)
+	require.Equal(t, []envVar{
+		{Name: "DB_PASSWORD", Secret: "db-password", SecretVersion: "1"},
+		{Name: "API_KEY", Secret: "api-key"},
+	}, jobs[0].Env)
+	require.Equal(t, []envFromSecret{{Secret: "db", SecretVersion: "2"}}, jobs[0].EnvFromSecret)
+
+	// Unchanged content adds no versions.
+	writes := fake.writes
+	synced, err = svc.syncManagedSecrets(ctx, cfg.secrets, false)
+	require.NoError(t, err)
+	require.Empty(t, synced.changes)
+	require.Equal(t, writes, fake.writes)
+}
+
+func Test_ManagedSecrets_Errors(t *testing.T) {
+	useSopsTestKey(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "jobs.yml")
+	require.NoError(t, os.WriteFile(file, []byte(`secrets:
+  - name: token
+    file: secrets.enc.yml
+    key: token
+  - name: token
+    file: other.enc.yml
+`), 0o600))
+	_, err := readConfig(readOptions{}, file)
+	require.EqualError(t, err, file+":5:5: duplicate secret \"token\", first defined at "+file+":2:5")
+
+	copyFile(t, "data/sops/secrets.enc.yml", filepath.Join(dir, "secrets.enc.yml"))
+	svc := &service{project: "test", secrets: newFakeSecretManager()}
+	_, err = svc.syncManagedSecrets(context.Background(), []managedSecret{
+		{Name: "token", File: filepath.Join(dir, "secrets.enc.yml"), Key: "token"},
+		{Name: "missing", File: filepath.Join(dir, "missing.enc.yml")},
+	}, true)
+	require.ErrorContains(t, err, `secret "token": `+filepath.Join(dir, "secrets.enc.yml")+`: no key "token"`)
+	require.ErrorContains(t, err, `secret "missing": could not read encrypted file`)
+	require.NotContains(t, err.Error(), "s3cret")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/pkg/errors"
+	"reflect"
+	"strings"
+)
+
+// matrixPrefix starts the placeholders replaced by the values of a job matrix,
+// e.g. ${matrix.tenant}.
+const matrixPrefix = "${matrix."
+
+// expandMatrix returns the jobs described by the matrix of j: one job per
+// combination of the matrix values, with ${matrix.<key>} replaced by the
+// values of that combination in every string field. Combinations are ordered
+// by key in alphabetical order. A job without a matrix is returned as is.
+// Errors are returned as an errorList.
+func expandMatrix(j job) ([]job, error) {
+	if len(j.Matrix) == 0 {
+		return []job{j}, nil
+	}
+
+	keys := pie.Sort(pie.Keys(j.Matrix))
+	for _, key := range keys {
+		if len(j.Matrix[key]) == 0 {
+			return nil, errorList{positionError{j.pos, fmt.Sprintf("job %q: matrix.%s has no values", j.Name, key)}}
+		}
+	}
+
+	var jobs []job
+	var errs errorList
+	reported := map[string]bool{}
+	seen := map[string]map[string]string{}
+	for _, values := range matrixCombinations(j.Matrix, keys) {
+		expanded := j
+		expanded.Matrix = nil
+		substitute := func(path, s string) string {
+			replaced, err := substituteMatrix(s, values)
+			if err != nil && !reported[path+err.Error()] {
+				reported[path+err.Error()] = true
+				errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: %s: %s", j.Name, path, err)})
+			}
+			return replaced
+		}
+		interpolateValue(reflect.ValueOf(&expanded).Elem(), "", substitute)
+		expanded.placeholders = nil
+		for _, p := range j.placeholders {
+			expanded.placeholders = append(expanded.placeholders, placeholder{p.path, substitute(p.path, p.value)})
+		}
+
+		if first, ok := seen[expanded.Name]; ok {
+			errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: matrix %s and %s both expand to job name %q", j.Name, formatMatrix(first, keys), formatMatrix(values, keys), expanded.Name)})
+			continue
+		}
+		seen[expanded.Name] = values
+		jobs = append(jobs, expanded)
+	}
+	return jobs, errs.err()
+}
+
+// matrixCombinations returns every combination of the values of matrix, the
+// last of keys varying fastest.
+func matrixCombinations(matrix map[string][]string, keys []string) []map[string]string {
+	combinations := []map[string]string{{}}
+	for _, key := range keys {
+		var next []map[string]string
+		for _, c := range combinations {
+			for _, value := range matrix[key] {
+				n := map[string]string{key: value}
+				for k, v := range c {
+					n[k] = v
+				}
+				next = append(next, n)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// substituteMatrix replaces the ${matrix.<key>} placeholders of s. Other
+// placeholders and escaped ones ($${matrix.<key>}) are left for
+// interpolateJobs. Like interpolateJobs, it reads $$ pairs from left to right,
+// so $$${matrix.<key>} is an escaped $ followed by a placeholder.
+func substituteMatrix(s string, values map[string]string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], "$$"):
+			b.WriteString("$$")
+			i += 2
+		case strings.HasPrefix(s[i:], matrixPrefix):
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", errors.Errorf("unterminated placeholder %s", s[i:])
+			}
+			key := s[i+len(matrixPrefix) : i+end]
+			value, ok := values[key]
+			if !ok {
+				return "", errors.Errorf("unknown matrix key ${matrix.%s}", key)
+			}
+			b.WriteString(value)
+			i += end + 1
+		default:
+			b.WriteByte(s[i])
+			i++
+		}
+	}
+	return b.String(), nil
+}
+
+func formatMatrix(values map[string]string, keys []string) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + "=" + values[key]
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
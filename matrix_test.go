@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_ReadJobsMatrix(t *testing.T) {
+	jobs, err := readJobs("data/matrix.yml")
+	require.NoError(t, err)
+	require.Equal(t, 5, len(jobs))
+
+	var names []string
+	for _, j := range jobs {
+		names = append(names, j.Name)
+		require.Nil(t, j.Matrix)
+	}
+	require.Equal(t, []string{"export-acme-full", "export-globex-full", "export-acme-delta", "export-globex-delta", "single"}, names)
+
+	j := jobs[3]
+	require.Equal(t, "0 3 * * *", j.Schedule)
+	require.Equal(t, "--tenant globex --kind delta --project ${PROJECT_ID}", j.Args)
+	require.Equal(t, []envVar{{Name: "TENANT", Value: "globex"}}, j.Env)
+	require.Equal(t, position{File: "data/matrix.yml", Line: 2, Column: 5}, j.pos)
+}
+
+func Test_ReadJobsMatrixInvalid(t *testing.T) {
+	_, err := readJobs("data/matrix_invalid.yml")
+	require.EqualError(t, err, "data/matrix_invalid.yml:2:5: job \"export-${matrix.tenant}\": args: unknown matrix key ${matrix.nope}\n"+
+		"data/matrix_invalid.yml:2:5: job \"export-${matrix.tenant}\": matrix {tenant=acme} and {tenant=acme} both expand to job name \"export-acme\"")
+}
+
+func Test_SubstituteMatrix(t *testing.T) {
+	values := map[string]string{"tenant": "acme"}
+	s, err := substituteMatrix("${matrix.tenant}/$${matrix.tenant}/${REGION}", values)
+	require.NoError(t, err)
+	require.Equal(t, "acme/$${matrix.tenant}/${REGION}", s)
+
+	s, err = substituteMatrix("$$${matrix.tenant}/$$$${matrix.tenant}/$$", values)
+	require.NoError(t, err)
+	require.Equal(t, "$$acme/$$$${matrix.tenant}/$$", s)
+
+	_, err = substituteMatrix("${matrix.tenant", values)
+	require.EqualError(t, err, "unterminated placeholder ${matrix.tenant")
+}
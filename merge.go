@@ -0,0 +1,135 @@
+package main
+
+import "gopkg.in/yaml.v3"
+
+// mergeNodes deep merges override on top of base and returns the result
+// without modifying either node:
+//
+//   - mappings are merged key by key,
+//   - lists whose items are all mappings with a name key (such as env) are
+//     merged item by item on that name, new items are appended,
+//   - anything else in override, including other lists, replaces base.
+//
+// A missing or null override keeps base. A value or list item tagged !delete
+// in override removes the corresponding value of base. Markers without a
+// counterpart in base are kept so that they also apply to the defaults and
+// templates merged later; removeDeleted strips them once merging is done.
+func mergeNodes(base, override *yaml.Node) *yaml.Node {
+	if base != nil && base.Kind == yaml.AliasNode {
+		base = base.Alias
+	}
+	if override != nil && override.Kind == yaml.AliasNode {
+		override = override.Alias
+	}
+	switch {
+	case override == nil || override.Tag == "!!null":
+		return base
+	case base == nil || base.Tag == "!!null":
+		return override
+	case base.Kind == yaml.MappingNode && override.Kind == yaml.MappingNode:
+		return mergeMappings(base, override)
+	case base.Kind == yaml.SequenceNode && override.Kind == yaml.SequenceNode && namedItems(base) && namedItems(override):
+		return mergeNamedItems(base, override)
+	default:
+		return override
+	}
+}
+
+func mergeMappings(base, override *yaml.Node) *yaml.Node {
+	merged := shallowCopy(override)
+	merged.Content = nil
+	for i := 0; i+1 < len(base.Content); i += 2 {
+		key := base.Content[i]
+		value := mappingValue(override, key.Value)
+		if isDeleted(value) {
+			continue
+		}
+		merged.Content = append(merged.Content, key, mergeNodes(base.Content[i+1], value))
+	}
+	for i := 0; i+1 < len(override.Content); i += 2 {
+		if mappingValue(base, override.Content[i].Value) == nil {
+			merged.Content = append(merged.Content, override.Content[i], override.Content[i+1])
+		}
+	}
+	return merged
+}
+
+func mergeNamedItems(base, override *yaml.Node) *yaml.Node {
+	merged := shallowCopy(override)
+	merged.Content = nil
+	for _, item := range base.Content {
+		value := namedItem(override, itemName(item))
+		if isDeleted(value) {
+			continue
+		}
+		merged.Content = append(merged.Content, mergeNodes(item, value))
+	}
+	for _, item := range override.Content {
+		if namedItem(base, itemName(item)) == nil {
+			merged.Content = append(merged.Content, item)
+		}
+	}
+	return merged
+}
+
+// deleteTag marks values that remove the corresponding value when merged.
+const deleteTag = "!delete"
+
+func isDeleted(n *yaml.Node) bool {
+	return n != nil && n.Tag == deleteTag
+}
+
+// removeDeleted returns a copy of n without the values tagged !delete. Scalar
+// nodes are shared with n.
+func removeDeleted(n *yaml.Node) *yaml.Node {
+	if n.Kind != yaml.MappingNode && n.Kind != yaml.SequenceNode {
+		return n
+	}
+	c := shallowCopy(n)
+	c.Content = nil
+	step := 1
+	if n.Kind == yaml.MappingNode {
+		step = 2
+	}
+	for i := 0; i+step-1 < len(n.Content); i += step {
+		value := n.Content[i+step-1]
+		if isDeleted(value) {
+			continue
+		}
+		c.Content = append(c.Content, n.Content[i:i+step-1]...)
+		c.Content = append(c.Content, removeDeleted(value))
+	}
+	return c
+}
+
+func shallowCopy(n *yaml.Node) *yaml.Node {
+	c := *n
+	return &c
+}
+
+// namedItems reports whether every item of the list n is a mapping with a
+// name key.
+func namedItems(n *yaml.Node) bool {
+	for _, item := range n.Content {
+		if itemName(item) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func itemName(n *yaml.Node) string {
+	if name := mappingValue(n, "name"); name != nil {
+		return name.Value
+	}
+	return ""
+}
+
+func namedItem(n *yaml.Node, name string) *yaml.Node {
+	for _, item := range n.Content {
+		if itemName(item) == name {
+			return item
+		}
+	}
+	return nil
+}
@@ -1,22 +1,129 @@
 package main
 
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"strconv"
+	"time"
+)
+
 type root struct {
-	Jobs []job
+	Include         []string
+	Vars            map[string]string
+	EnvGroups       map[string][]envVar `yaml:"env_groups"`
+	Defaults        *jobDefaults
+	Templates       map[string]jobTemplate
+	Secrets         []managedSecret
+	ServiceAccounts []serviceAccount `yaml:"service_accounts"`
+	ImagePolicy     *imagePolicy     `yaml:"image_policy"`
+	Jobs            []job
+}
+
+// managedSecret is a Secret Manager secret whose content gruns keeps in sync
+// with a SOPS encrypted file.
+type managedSecret struct {
+	Name string
+	File string
+	Key  string
+
+	pos position
+}
+
+// serviceAccount is a service account gruns creates and owns. Jobs refer to it
+// by its name.
+type serviceAccount struct {
+	Name        string
+	DisplayName string `yaml:"display_name"`
+	Description string
+	Roles       []string
+
+	pos position
+}
+
+// imagePolicy restricts the images the jobs may run.
+type imagePolicy struct {
+	AllowedRegistries []string `yaml:"allowed_registries"`
+	ForbidLatest      bool     `yaml:"forbid_latest"`
+	RequireDigest     bool     `yaml:"require_digest"`
+
+	pos  position
+	vars map[string]string
+}
+
+// imagePolicyExemption exempts a job from rules of the image policy.
+type imagePolicyExemption struct {
+	Rules  []string
+	Reason string
 }
 
+// jobDefaults holds file-level settings that are deep merged under every job,
+// see mergeNodes. It accepts every job field except name.
+type jobDefaults job
+
+// jobTemplate holds settings shared by a family of jobs. Jobs and other
+// templates inherit them with extends. It accepts every job field except name.
+type jobTemplate job
+
 type job struct {
 	Name           string
+	Description    string
+	Extends        string
+	Matrix         map[string][]string
 	ServiceAccount string `yaml:"service_account"`
-	Parallelism    int
-	Tasks          int
-	Retries        int
-	Timeout        int
+	Parallelism    *int
+	Tasks          *int
+	Retries        *int
+	Timeout        *duration
+	Registry       string
 	Image          string
 	Schedule       string
+	Timezone       string
+	Trigger        *trigger
 	Args           string
 	Cpu            string
 	Memory         string
 	Env            []envVar
+	EnvFromSecret  []envFromSecret `yaml:"env_from_secret"`
+	EnvGroups      []string        `yaml:"env_groups"`
+	EnvFile        string          `yaml:"env_file"`
+	Labels         map[string]string
+	Roles          []string
+
+	EncryptionKey        string                `yaml:"encryption_key"`
+	ExecutionEnvironment string                `yaml:"execution_environment"`
+	LaunchStage          string                `yaml:"launch_stage"`
+	BinaryAuthorization  *binaryAuthorization  `yaml:"binary_authorization"`
+	ImagePolicyExemption *imagePolicyExemption `yaml:"image_policy_exemption"`
+
+	pos     position
+	origins map[string]origin
+	vars    map[string]string
+	// varSources lists the variables interpolated into each field.
+	varSources map[string][]string
+	// iamBindings are the bindings gruns added for the job, recorded on the
+	// run job.
+	iamBindings []iamBinding
+	// imageTag is the image as declared when Image was resolved to a digest.
+	imageTag string
+	// placeholders are the integer and duration fields set to a placeholder,
+	// which are decoded once interpolated.
+	placeholders []placeholder
+}
+
+// trigger holds the Cloud Scheduler settings of a scheduled job.
+type trigger struct {
+	ServiceAccount  string    `yaml:"service_account"`
+	RetryCount      *int      `yaml:"retry_count"`
+	AttemptDeadline *duration `yaml:"attempt_deadline"`
+}
+
+// binaryAuthorization selects how Binary Authorization is enforced for a job:
+// either the project's default policy or a named platform policy, optionally
+// bypassed with a breakglass justification.
+type binaryAuthorization struct {
+	UseDefault              bool   `yaml:"use_default"`
+	Policy                  string `yaml:"policy"`
+	BreakglassJustification string `yaml:"breakglass_justification"`
 }
 
 type envVar struct {
@@ -24,6 +131,17 @@ type envVar struct {
 	Value         string
 	Secret        string
 	SecretVersion string `yaml:"secret_version"`
+	// sensitive marks values read from Secret Manager, they are never printed.
+	sensitive bool
+}
+
+// envFromSecret expands a Secret Manager secret holding a JSON object into
+// one env var per top-level key, named <prefix><KEY>.
+type envFromSecret struct {
+	Secret        string
+	SecretVersion string `yaml:"secret_version"`
+	Prefix        string
+	Mode          string
 }
 
 type args struct {
@@ -31,7 +149,43 @@ type args struct {
 	ProjectNumber   string
 	Region          string
 	DisableTriggers bool
+	Protected       bool
 	ServiceAccount  string
 	TriggerAccount  string
-	FileName        string
+	FileNames       []string
+	Env             string
+	Vars            []string
+	VarFiles        []string
+	Template        bool
+	SkipSecretCheck bool
+	ResolveDigests  bool
+	Policies        []string
+}
+
+// duration is a time.Duration that can be written in jobs.yml either as a
+// number of seconds (900) or as a Go duration string ("90m", "1h30m").
+type duration time.Duration
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *duration) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind != yaml.ScalarNode {
+		return errors.New("invalid duration, expected seconds or a duration like 90m")
+	}
+	if seconds, err := strconv.Atoi(n.Value); err == nil {
+		*d = duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	parsed, err := time.ParseDuration(n.Value)
+	if err != nil {
+		return errors.Errorf("invalid duration %q, expected seconds or a duration like 90m", n.Value)
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
 }
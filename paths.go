@@ -0,0 +1,188 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// expandPaths turns files, directories and glob patterns into the list of
+// jobs files they refer to. Relative patterns are resolved against dir.
+// Directories are searched recursively for .yml and .yaml files and patterns
+// support ** to match any number of directories. The overlays of env found
+// that way are skipped, they are applied to their base file instead, and so
+// are SOPS encrypted files, which hold secrets rather than jobs.
+func expandPaths(patterns []string, dir, env string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		if dir != "" && !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		pattern = filepath.Clean(pattern)
+
+		var matches []string
+		var err error
+		switch {
+		case strings.ContainsAny(pattern, "*?["):
+			matches, err = globFiles(pattern)
+			if err == nil && len(matches) == 0 {
+				err = errors.Errorf("no files match %s", pattern)
+			}
+		case isDir(pattern):
+			matches, err = walkFiles(pattern, isYamlFile)
+		default:
+			matches = []string{pattern}
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if match != pattern && isOverlayFile(match, env) {
+				log.Warn().Msgf("skipping %s, it is applied as the %s overlay of its base file", match, env)
+				continue
+			}
+			if match != pattern && isSopsFile(match) {
+				log.Debug().Msgf("skipping %s, it is encrypted with SOPS", match)
+				continue
+			}
+			files = append(files, match)
+		}
+	}
+	return files, nil
+}
+
+func globFiles(pattern string) ([]string, error) {
+	re, err := globRegex(filepath.ToSlash(pattern))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern %s", pattern)
+	}
+	return walkFiles(globRoot(pattern), func(path string) bool {
+		return re.MatchString(filepath.ToSlash(path))
+	})
+}
+
+// globRoot returns the directory of pattern that precedes the first path
+// element containing a wildcard.
+func globRoot(pattern string) string {
+	var root []string
+	for _, elem := range strings.Split(filepath.ToSlash(pattern), "/") {
+		if strings.ContainsAny(elem, "*?[") {
+			break
+		}
+		root = append(root, elem)
+	}
+	if len(root) == 0 {
+		return "."
+	}
+	if len(root) == 1 && root[0] == "" {
+		return "/"
+	}
+	return filepath.FromSlash(strings.Join(root, "/"))
+}
+
+// globRegex translates a slash separated glob pattern into a regular
+// expression. * and ? do not match /, ** matches any number of directories.
+func globRegex(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func walkFiles(root string, match func(path string) bool) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && match(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func isYamlFile(path string) bool {
+	ext := filepath.Ext(strings.TrimSuffix(path, templateExt))
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// sopsKeyRegex matches the top-level sops key of an encrypted file.
+var sopsKeyRegex = regexp.MustCompile(`(?m)^sops:`)
+
+// isSopsFile reports whether path is a SOPS encrypted file: it is named like
+// secrets.enc.yml or has a top-level sops key.
+func isSopsFile(path string) bool {
+	name := strings.TrimSuffix(path, filepath.Ext(path))
+	if filepath.Ext(name) == ".enc" {
+		return true
+	}
+	if isTemplateFile(path) {
+		return false
+	}
+	b, err := os.ReadFile(path)
+	return err == nil && sopsKeyRegex.Match(b)
+}
+
+// isOverlayFile reports whether path is the overlay for env of another jobs
+// file in the same directory, e.g. jobs.production.yml next to jobs.yml.
+func isOverlayFile(path, env string) bool {
+	if env == "" {
+		return false
+	}
+	suffix := ""
+	if isTemplateFile(path) {
+		suffix = templateExt
+		path = strings.TrimSuffix(path, templateExt)
+	}
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(path, ext)
+	if filepath.Ext(name) != "."+env {
+		return false
+	}
+	_, err := os.Stat(strings.TrimSuffix(name, "."+env) + ext + suffix)
+	return err == nil
+}
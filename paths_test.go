@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ExpandPaths(t *testing.T) {
+	files, err := expandPaths([]string{"data/multi"}, "", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"data/multi/jobs.yml",
+		"data/multi/shared/templates.yml",
+		"data/multi/teams/a/jobs.yml",
+		"data/multi/teams/b/jobs.yml",
+	}, files)
+
+	files, err = expandPaths([]string{"data/multi/teams/**/*.yml"}, "", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"data/multi/teams/a/jobs.yml", "data/multi/teams/b/jobs.yml"}, files)
+
+	files, err = expandPaths([]string{"shared/*.yml", "jobs.yml"}, "data/multi", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"data/multi/shared/templates.yml", "data/multi/jobs.yml"}, files)
+
+	// Only the overlays of the selected env are skipped.
+	files, err = expandPaths([]string{"data/overlays"}, "", "production")
+	require.NoError(t, err)
+	require.Equal(t, []string{"data/overlays/jobs.yml"}, files)
+
+	files, err = expandPaths([]string{"data/overlays/*.yml"}, "", "staging")
+	require.NoError(t, err)
+	require.Equal(t, []string{"data/overlays/jobs.production.yml", "data/overlays/jobs.yml"}, files)
+
+	files, err = expandPaths([]string{"data/overlays"}, "", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"data/overlays/jobs.production.yml", "data/overlays/jobs.yml"}, files)
+
+	_, err = expandPaths([]string{"data/multi/*.yaml"}, "", "")
+	require.EqualError(t, err, "no files match data/multi/*.yaml")
+}
+
+func Test_ExpandPaths_SkipsSopsFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "jobs.yml"), []byte("secrets:\n  - name: app\n    file: secrets.enc.yml\njobs:\n  - name: export\n    image: exporter\n"), 0o644))
+	copyFile(t, "data/sops/secrets.enc.yml", filepath.Join(dir, "secrets.enc.yml"))
+	copyFile(t, "data/sops/types.enc.yml", filepath.Join(dir, "credentials.yaml"))
+
+	for _, pattern := range []string{dir, filepath.Join(dir, "*.y*ml")} {
+		files, err := expandPaths([]string{pattern}, "", "")
+		require.NoError(t, err)
+		require.Equal(t, []string{filepath.Join(dir, "jobs.yml")}, files)
+	}
+
+	jobs, err := readJobs(dir)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+}
+
+func Test_GlobRegex(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"jobs/*.yml", "jobs/a.yml", true},
+		{"jobs/*.yml", "jobs/sub/a.yml", false},
+		{"jobs/**/*.yml", "jobs/a.yml", true},
+		{"jobs/**/*.yml", "jobs/sub/deep/a.yml", true},
+		{"jobs/**", "jobs/sub/a.yml", true},
+		{"jobs/?.yml", "jobs/a.yml", true},
+		{"jobs/[ab].yml", "jobs/c.yml", false},
+		{"jobs/[!ab].yml", "jobs/c.yml", true},
+		{"jobs.*.yml", "jobs.production.yml", true},
+	}
+	for _, tt := range tests {
+		re, err := globRegex(tt.pattern)
+		require.NoError(t, err)
+		require.Equal(t, tt.match, re.MatchString(tt.path), "%s %s", tt.pattern, tt.path)
+	}
+}
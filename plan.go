@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// plan prints the changes apply would make to the run jobs and triggers
+// without making them.
+func plan(args args) error {
+	args = withDefaultAccounts(args)
+
+	ctx := context.Background()
+	svc := initializeService(ctx, args)
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+
+	synced, err := svc.syncManagedSecrets(ctx, cfg.secrets, true)
+	if err != nil {
+		return err
+	}
+	jobs := svc.pinManagedSecrets(cfg.jobs, synced.versions)
+
+	if args.ResolveDigests {
+		jobs, err = newDigestResolver().resolveDigests(ctx, jobs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !args.SkipSecretCheck {
+		err = svc.checkSecrets(ctx, jobs, synced.pending)
+		if err != nil {
+			return err
+		}
+	}
+
+	jobs, secretChanges, err := svc.expandSecretEnv(ctx, jobs, true)
+	if err != nil {
+		return err
+	}
+	for _, change := range append(synced.changes, secretChanges...) {
+		fmt.Println(change)
+	}
+
+	accounts, err := svc.planServiceAccounts(ctx, cfg.accounts, jobs)
+	if err != nil {
+		return err
+	}
+	for _, change := range accounts.changes() {
+		fmt.Println(change)
+	}
+
+	recorded, err := recordedBindings(svc)
+	if err != nil {
+		return errors.Wrapf(err, "list run jobs error")
+	}
+	iam, err := svc.planIam(ctx, jobs, cfg.accounts, accounts.owned, recorded)
+	if err != nil {
+		return err
+	}
+	for i, j := range jobs {
+		jobs[i].iamBindings = iam.records[j.Name]
+	}
+
+	var jobNames []string
+	var triggerNames []string
+
+	for _, j := range jobs {
+		jobNames = append(jobNames, j.Name)
+
+		if j.Schedule != "" {
+			triggerNames = append(triggerNames, j.Name+triggerSuffix)
+			scheduledJob, err := svc.getSchedulerJob(ctx, j.Name)
+			switch {
+			case status.Code(err) == codes.NotFound:
+				fmt.Printf("+ trigger %s [%s]\n", j.Name+triggerSuffix, j.pos)
+			case err != nil:
+				return errors.Wrapf(err, "scheduler job error: %s", j.Name)
+			default:
+				update, err := updateSchedulerJob(svc, scheduledJob, j)
+				if err != nil {
+					return errors.Wrapf(err, "scheduler job error: %s", j.Name)
+				}
+				if len(update) > 0 {
+					fmt.Printf("~ trigger %s (%s) [%s]\n", j.Name+triggerSuffix, strings.Join(update, ", "), j.pos)
+				}
+			}
+		}
+
+		runJob, err := svc.getRunJob(ctx, j.Name)
+		switch {
+		case status.Code(err) == codes.NotFound:
+			fmt.Printf("+ job %s [%s]\n", j.Name, j.pos)
+			printImageDigest(j, "")
+			printOverlayValues(j)
+		case err != nil:
+			return errors.Wrapf(err, "run job error: %s", j.Name)
+		default:
+			deployed := runJob.Template.Template.Containers[0].Image
+			if fieldMask := updateJob(runJob, j); len(fieldMask) > 0 {
+				fmt.Printf("~ job %s (%s) [%s]\n", j.Name, strings.Join(fieldMask, ", "), j.pos)
+				printImageDigest(j, deployed)
+				printOverlayValues(j)
+			}
+		}
+	}
+
+	staleTriggers, err := staleSchedulerJobs(svc, triggerNames)
+	if err != nil {
+		return errors.Wrapf(err, "list scheduler jobs error")
+	}
+	for _, name := range staleTriggers {
+		fmt.Printf("- trigger %s\n", trimParent(svc.parent(), name))
+	}
+
+	staleJobs, err := staleRunJobs(svc, jobNames)
+	if err != nil {
+		return errors.Wrapf(err, "list run jobs error")
+	}
+	for _, name := range staleJobs {
+		fmt.Printf("- job %s\n", trimParent(svc.parent(), name))
+	}
+
+	for _, change := range iam.changes() {
+		fmt.Println(change)
+	}
+
+	for _, w := range append(cfg.warnings, planWarnings(args, jobs)...) {
+		fmt.Printf("! %s\n", w)
+	}
+	return nil
+}
+
+// printImageDigest shows the digest the image tag of j resolved to when it
+// differs from the deployed image.
+func printImageDigest(j job, deployed string) {
+	if j.imageTag != "" && j.Image != deployed {
+		fmt.Printf("    image %s -> %s\n", j.imageTag, j.Image)
+	}
+}
+
+// printOverlayValues lists the values of j that come from an environment
+// overlay together with their location.
+func printOverlayValues(j job) {
+	for _, field := range overlayFields(j) {
+		fmt.Printf("    %s from %s\n", field, j.origins[field])
+	}
+}
+
+// overlayFields returns the sorted paths of the fields of j set by an overlay.
+func overlayFields(j job) []string {
+	var fields []string
+	for field, o := range j.origins {
+		if strings.HasPrefix(o.Source, "overlay ") {
+			fields = append(fields, field)
+		}
+	}
+	return pie.Sort(fields)
+}
+
+// planWarnings returns issues that do not block a deployment but should be
+// brought to the attention of whoever runs it.
+func planWarnings(args args, jobs []job) []string {
+	var warnings []string
+	for _, j := range jobs {
+		if args.Protected && j.BinaryAuthorization == nil {
+			warnings = append(warnings, fmt.Sprintf("%s: job %s has no binary_authorization but the target project is protected", j.pos, j.Name))
+		}
+		if e := j.ImagePolicyExemption; e != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: job %s is exempted from the image policy rules %s: %s", j.pos, j.Name, strings.Join(e.Rules, ", "), e.Reason))
+		}
+	}
+	return warnings
+}
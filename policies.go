@@ -0,0 +1,250 @@
+package main
+
+import (
+	"cloud.google.com/go/run/apiv2/runpb"
+	"fmt"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"time"
+)
+
+const (
+	severityError = "error"
+	severityWarn  = "warn"
+)
+
+// policyFile is a file of organization rules, see --policy.
+type policyFile struct {
+	Policies []policy
+}
+
+// policy is a rule written in CEL that every job must satisfy. The expression
+// sees the resolved job as job, its Cloud Run job as run, the environment as
+// env and the project as project, and returns true when the job complies.
+type policy struct {
+	Name        string
+	Description string
+	Expression  string
+	Severity    string
+
+	pos     position
+	program cel.Program
+}
+
+// policyEnv declares the variables and the helpers available to policies.
+func policyEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Types(&runpb.Job{}),
+		cel.Variable("job", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("run", cel.ObjectType("google.cloud.run.v2.Job")),
+		cel.Variable("env", cel.StringType),
+		cel.Variable("project", cel.StringType),
+		cel.Function("memoryBytes",
+			cel.Overload("memoryBytes_string", []*cel.Type{cel.StringType}, cel.IntType,
+				cel.UnaryBinding(func(v ref.Val) ref.Val {
+					bytes, err := parseMemory(string(v.(types.String)))
+					if err != nil {
+						return types.NewErr("%s", err)
+					}
+					return types.Int(bytes)
+				}))),
+		cel.Function("cpuMillis",
+			cel.Overload("cpuMillis_string", []*cel.Type{cel.StringType}, cel.IntType,
+				cel.UnaryBinding(func(v ref.Val) ref.Val {
+					millis, err := parseCpu(string(v.(types.String)))
+					if err != nil {
+						return types.NewErr("%s", err)
+					}
+					return types.Int(millis)
+				}))),
+		cel.Function("cronInterval",
+			cel.Overload("cronInterval_string", []*cel.Type{cel.StringType}, cel.DurationType,
+				cel.UnaryBinding(func(v ref.Val) ref.Val {
+					interval, err := cronInterval(string(v.(types.String)))
+					if err != nil {
+						return types.NewErr("%s", err)
+					}
+					return types.Duration{Duration: interval}
+				}))),
+	)
+}
+
+// readPolicies reads and compiles the policies of files, reporting every
+// invalid policy at once.
+func readPolicies(files []string) ([]policy, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	env, err := policyEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []policy
+	var errs errorList
+	defined := map[string]position{}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read policy file %s", file)
+		}
+		var doc yaml.Node
+		err = yaml.Unmarshal(b, &doc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse policy file %s", file)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		if list := checkNode(file, doc.Content[0], reflect.TypeOf(policyFile{})); len(list) > 0 {
+			errs = append(errs, list...)
+			continue
+		}
+		var f policyFile
+		err = doc.Decode(&f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not unmarshal policy file %s", file)
+		}
+		items := mappingValue(doc.Content[0], "policies")
+		for i, p := range f.Policies {
+			p.pos = position{File: file, Line: items.Content[i].Line, Column: items.Content[i].Column}
+			if first, ok := defined[p.Name]; ok {
+				errs = append(errs, positionError{p.pos, fmt.Sprintf("duplicate policy %q, first defined at %s", p.Name, first)})
+				continue
+			}
+			defined[p.Name] = p.pos
+			err := p.compile(env)
+			if err != nil {
+				errs = append(errs, positionError{p.pos, fmt.Sprintf("policy %q: %s", p.Name, err)})
+				continue
+			}
+			policies = append(policies, p)
+		}
+	}
+	return policies, errs.err()
+}
+
+func (p *policy) compile(env *cel.Env) error {
+	if p.Name == "" {
+		return errors.New("name cannot be empty")
+	}
+	switch p.Severity {
+	case "":
+		p.Severity = severityError
+	case severityError, severityWarn:
+	default:
+		return errors.Errorf("severity must be %s or %s, got %q", severityError, severityWarn, p.Severity)
+	}
+	ast, issues := env.Compile(p.Expression)
+	if issues.Err() != nil {
+		return errors.Errorf("invalid expression: %s", issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return errors.Errorf("expression must return a bool, got %s", ast.OutputType())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return err
+	}
+	p.program = program
+	return nil
+}
+
+// evaluatePolicies evaluates policies against every job. Violations of error
+// policies and expressions that cannot be evaluated are returned as errors,
+// violations of warn policies as warnings.
+func evaluatePolicies(args args, policies []policy, jobs []job) ([]string, error) {
+	var warnings []string
+	var errs errorList
+	for _, j := range jobs {
+		vars, err := policyVars(args, j)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range policies {
+			out, _, err := p.program.Eval(vars)
+			if err != nil {
+				errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: policy %q could not be evaluated: %s", j.Name, p.Name, err)})
+				continue
+			}
+			if out == types.True {
+				continue
+			}
+			msg := fmt.Sprintf("job %q violates policy %q", j.Name, p.Name)
+			if p.Description != "" {
+				msg += ": " + p.Description
+			}
+			if p.Severity == severityWarn {
+				warnings = append(warnings, fmt.Sprintf("%s: %s", j.pos, msg))
+				continue
+			}
+			errs = append(errs, positionError{j.pos, msg})
+		}
+	}
+	return warnings, errs.err()
+}
+
+// policyVars returns the variables policies are evaluated with for j. The job
+// has the keys of jobs.yml, unset fields are left out except labels, which is
+// always a map.
+func policyVars(args args, j job) (map[string]interface{}, error) {
+	b, err := yaml.Marshal(j)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	err = yaml.Unmarshal(b, &fields)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		if v == nil {
+			delete(fields, k)
+		}
+	}
+	if fields["labels"] == nil {
+		fields["labels"] = map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"job":     fields,
+		"run":     createRunJobFromJob(j),
+		"env":     args.Env,
+		"project": args.ProjectId,
+	}, nil
+}
+
+// cronInterval returns the shortest time between two runs of schedule over a
+// year, in UTC.
+func cronInterval(schedule string) (time.Duration, error) {
+	s, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid schedule %q", schedule)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, 0)
+	var shortest time.Duration
+	prev := s.Next(start)
+	for i := 0; i < 100000 && shortest != time.Minute; i++ {
+		next := s.Next(prev)
+		if next.IsZero() {
+			break
+		}
+		if d := next.Sub(prev); shortest == 0 || d < shortest {
+			shortest = d
+		}
+		if !next.Before(end) {
+			break
+		}
+		prev = next
+	}
+	if shortest == 0 {
+		return 0, errors.Errorf("schedule %q never runs", schedule)
+	}
+	return shortest, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_Policies(t *testing.T) {
+	a := args{ProjectId: "test", FileNames: []string{"data/policies/jobs.yml"}, Policies: []string{"data/policies/policies.yml"}}
+	_, err := loadConfig(a)
+	require.EqualError(t, err, `data/policies/jobs.yml:7:5: job "poll" violates policy "max-memory": Jobs use at most 8Gi of memory.`+"\n"+
+		`data/policies/jobs.yml:7:5: job "poll" violates policy "min-interval": Jobs run at most every 5 minutes.`+"\n"+
+		`data/policies/jobs.yml:15:5: job "cleanup" violates policy "owner-label": Every job has an owner label.`)
+
+	jobs, err := readJobs("data/policies/jobs.yml")
+	require.NoError(t, err)
+	for i, j := range jobs {
+		jobs[i] = convertToRunJob("runner@test", j)
+	}
+	policies, err := readPolicies(a.Policies)
+	require.NoError(t, err)
+	a.Env = "production"
+	warnings, err := evaluatePolicies(a, policies[3:], jobs)
+	require.NoError(t, err)
+	require.Equal(t, []string{`data/policies/jobs.yml:7:5: job "poll" violates policy "production-retries": Production jobs retry failed tasks.`}, warnings)
+}
+
+func Test_Policies_Invalid(t *testing.T) {
+	_, err := readPolicies([]string{"data/policies/invalid.yml"})
+	require.ErrorContains(t, err, `data/policies/invalid.yml:2:5: policy "typo": invalid expression: ERROR: <input>:1:25: found no matching overload for '_<=_'`)
+	require.ErrorContains(t, err, `data/policies/invalid.yml:4:5: policy "not-bool": expression must return a bool, got int`)
+	require.ErrorContains(t, err, `data/policies/invalid.yml:6:5: policy "severity": severity must be error or warn, got "fatal"`)
+	require.ErrorContains(t, err, `data/policies/invalid.yml:9:5: duplicate policy "typo", first defined at data/policies/invalid.yml:2:5`)
+}
+
+func Test_Policies_UnknownFields(t *testing.T) {
+	_, err := readPolicies([]string{"data/policies/unknown.yml", "data/policies/invalid.yml"})
+	require.ErrorContains(t, err, `data/policies/unknown.yml:4:5: unknown field "severty"`)
+	require.ErrorContains(t, err, `data/policies/unknown.yml:6:1: unknown field "polices"`)
+	require.ErrorContains(t, err, `data/policies/invalid.yml:2:5: policy "typo"`)
+}
+
+func Test_CronInterval(t *testing.T) {
+	for schedule, want := range map[string]time.Duration{
+		"* * * * *":      time.Minute,
+		"*/15 * * * *":   15 * time.Minute,
+		"0,5 * * * *":    5 * time.Minute,
+		"0 3 * * *":      24 * time.Hour,
+		"0 0 1 1 *":      365 * 24 * time.Hour,
+		"30 9 * * 1-5":   24 * time.Hour,
+		"0 */6 1,15 * *": 6 * time.Hour,
+	} {
+		got, err := cronInterval(schedule)
+		require.NoError(t, err, schedule)
+		require.Equal(t, want, got, schedule)
+	}
+	_, err := cronInterval("every minute")
+	require.Error(t, err)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+// origin records where the value of a job field came from.
+type origin struct {
+	Source string
+	Pos    position
+}
+
+func (o origin) String() string {
+	if o.Pos.File == "" {
+		return o.Source
+	}
+	return fmt.Sprintf("%s (%s)", o.Source, o.Pos)
+}
+
+// origins maps the yaml nodes of the loaded files to their origin so that the
+// origin of every value survives merging.
+type origins map[*yaml.Node]origin
+
+// markFile records the origin of the nodes of the jobs file body.
+func (o origins) markFile(file string, body *yaml.Node) {
+	if defaults := mappingValue(body, "defaults"); defaults != nil {
+		o.mark(file, defaults, "file default")
+	}
+	if templates := mappingValue(body, "templates"); templates != nil {
+		for i := 0; i+1 < len(templates.Content); i += 2 {
+			o.mark(file, templates.Content[i+1], "template "+templates.Content[i].Value)
+		}
+	}
+	if groups := mappingValue(body, "env_groups"); groups != nil {
+		for i := 0; i+1 < len(groups.Content); i += 2 {
+			o.mark(file, groups.Content[i+1], "env group "+groups.Content[i].Value)
+		}
+	}
+	if jobs := mappingValue(body, "jobs"); jobs != nil {
+		o.mark(file, jobs, "job")
+	}
+}
+
+// mark records source as the origin of n and everything below it.
+func (o origins) mark(file string, n *yaml.Node, source string) {
+	o[n] = origin{Source: source, Pos: position{File: file, Line: n.Line, Column: n.Column}}
+	for _, c := range n.Content {
+		o.mark(file, c, source)
+	}
+}
+
+// fieldOrigins returns the origin of every scalar value of the job node n,
+// keyed by its path, e.g. memory, labels.team or env[FOO].value. The names
+// identifying the job and its list items are left out.
+func (o origins) fieldOrigins(n *yaml.Node) map[string]origin {
+	fields := map[string]origin{}
+	o.collect(n, "", fields)
+	return fields
+}
+
+func (o origins) collect(n *yaml.Node, path string, fields map[string]origin) {
+	switch n.Kind {
+	case yaml.AliasNode:
+		o.collect(n.Alias, path, fields)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			if key == "name" && (path == "" || strings.HasSuffix(path, "]")) {
+				continue
+			}
+			o.collect(n.Content[i+1], joinPath(path, key), fields)
+		}
+	case yaml.SequenceNode:
+		named := namedItems(n)
+		for i, item := range n.Content {
+			if named {
+				o.collect(item, fmt.Sprintf("%s[%s]", path, itemName(item)), fields)
+			} else {
+				o.collect(item, fmt.Sprintf("%s[%d]", path, i), fields)
+			}
+		}
+	case yaml.ScalarNode:
+		if orig, ok := o[n]; ok {
+			fields[path] = orig
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var memoryUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"Ki", 1 << 10},
+	{"Mi", 1 << 20},
+	{"Gi", 1 << 30},
+	{"Ti", 1 << 40},
+	{"k", 1e3},
+	{"M", 1e6},
+	{"G", 1e9},
+	{"T", 1e12},
+}
+
+// parseCpu parses a Kubernetes style cpu quantity ("1", "0.5", "1000m") into
+// millicpus.
+func parseCpu(s string) (int64, error) {
+	if strings.HasSuffix(s, "m") {
+		millis, err := strconv.ParseInt(strings.TrimSuffix(s, "m"), 10, 64)
+		if err != nil || millis <= 0 {
+			return 0, errors.Errorf("invalid cpu quantity %q", s)
+		}
+		return millis, nil
+	}
+	cpus, err := strconv.ParseFloat(s, 64)
+	if err != nil || cpus <= 0 || math.IsInf(cpus, 0) {
+		return 0, errors.Errorf("invalid cpu quantity %q", s)
+	}
+	return int64(math.Round(cpus * 1000)), nil
+}
+
+// parseMemory parses a Kubernetes style memory quantity ("512Mi", "1G",
+// "1073741824") into bytes.
+func parseMemory(s string) (int64, error) {
+	multiplier := 1.0
+	number := s
+	for _, u := range memoryUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			multiplier = u.multiplier
+			number = strings.TrimSuffix(s, u.suffix)
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 || math.IsInf(value, 0) {
+		return 0, errors.Errorf("invalid memory quantity %q", s)
+	}
+	return int64(value * multiplier), nil
+}
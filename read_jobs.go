@@ -1,21 +1,371 @@
 package main
 
 import (
-	"github.com/ghodss/yaml"
+	"fmt"
 	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 )
 
-func readJobs(file string) ([]job, error) {
+var fileSchema = jobsSchema()
+
+// jobFile is a parsed jobs.yml file.
+type jobFile struct {
+	path string
+	root root
+	body *yaml.Node
+}
+
+// readOptions control how jobs files are read.
+type readOptions struct {
+	// Env selects the overlay applied on top of every file, e.g. production
+	// applies jobs.production.yml to jobs.yml.
+	Env string
+	// Template renders every file as a Go template before parsing it. Files
+	// ending in .tmpl are always rendered.
+	Template bool
+	// Data is the data the templates are executed with.
+	Data map[string]interface{}
+}
+
+// readJobs loads the jobs defined in the given files, directories and glob
+// patterns, and in every file they include. Defaults apply to the jobs of the
+// file they are defined in, templates are shared by all files.
+func readJobs(paths ...string) ([]job, error) {
+	return readJobsWith(readOptions{}, paths...)
+}
+
+func readJobsWith(opts readOptions, paths ...string) ([]job, error) {
+	cfg, err := readConfig(opts, paths...)
+	return cfg.jobs, err
+}
+
+// config holds everything defined by the jobs files.
+type config struct {
+	jobs     []job
+	secrets  []managedSecret
+	accounts []serviceAccount
+	policy   *imagePolicy
+	// warnings holds the violations of the policies of severity warn.
+	warnings []string
+	files    []*jobFile
+}
+
+// readConfig loads the jobs, the managed secrets, the service accounts and
+// the image policy defined in the given files, directories and glob patterns, and in every file
+// they include.
+func readConfig(opts readOptions, paths ...string) (config, error) {
+	marks := origins{}
+	files, err := loadJobFiles(paths, opts, marks)
+	if err != nil {
+		return config{}, err
+	}
+
+	templates, err := collectTemplates(files)
+	if err != nil {
+		return config{}, err
+	}
+	groups, err := collectEnvGroups(files, marks)
+	if err != nil {
+		return config{}, err
+	}
+	secrets, err := collectManagedSecrets(files)
+	if err != nil {
+		return config{}, err
+	}
+	accounts, err := collectServiceAccounts(files)
+	if err != nil {
+		return config{}, err
+	}
+	policy, err := collectImagePolicy(files)
+	if err != nil {
+		return config{}, err
+	}
+
+	var jobs []job
+	var errs errorList
+	for _, f := range files {
+		defaults := mappingValue(f.body, "defaults")
+		jobsNode := mappingValue(f.body, "jobs")
+		if jobsNode == nil {
+			continue
+		}
+		for _, n := range jobsNode.Content {
+			if isDeleted(n) {
+				continue
+			}
+			resolved, err := templates.extend(f.path, n)
+			if err != nil {
+				return config{}, err
+			}
+			merged := removeDeleted(mergeNodes(defaults, resolved))
+			decoded := removeDeleted(merged)
+			placeholders := takePlaceholders(decoded, reflect.TypeOf(job{}), "")
+			var j job
+			err = decoded.Decode(&j)
+			if err != nil {
+				return config{}, errors.Wrapf(err, "could not unmarshal %s", f.path)
+			}
+			j.placeholders = placeholders
+			j.pos = position{File: f.path, Line: n.Line, Column: n.Column}
+			j.origins = marks.fieldOrigins(merged)
+			j.vars = f.root.Vars
+			expanded, err := expandMatrix(j)
+			if err != nil {
+				errs.add(err)
+				continue
+			}
+			for _, j := range expanded {
+				j, err = groups.resolveEnv(j)
+				if err != nil {
+					errs.add(err)
+					continue
+				}
+				jobs = append(jobs, j)
+			}
+		}
+	}
+	return config{jobs: jobs, secrets: secrets, accounts: accounts, policy: policy, files: files}, errs.err()
+}
+
+// loadJobFiles parses the files matched by paths followed by the files they
+// include, applying the overlay of opts.Env to each of them. Every file is loaded
+// once and all errors are reported together.
+func loadJobFiles(paths []string, opts readOptions, marks origins) ([]*jobFile, error) {
+	matches, err := expandPaths(paths, "", opts.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*jobFile
+	var errs errorList
+	loaded := map[string]bool{}
+	for len(matches) > 0 {
+		path := matches[0]
+		matches = matches[1:]
+		if loaded[path] {
+			continue
+		}
+		loaded[path] = true
+
+		f, err := readJobFile(path, opts)
+		if err == nil && f != nil {
+			marks.markFile(f.path, f.body)
+			err = applyOverlay(f, opts, marks)
+		}
+		if err != nil {
+			errs.add(err)
+			continue
+		}
+		if f == nil {
+			continue
+		}
+		files = append(files, f)
+
+		includes, err := expandPaths(f.root.Include, filepath.Dir(path), opts.Env)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "%s: include", path))
+			continue
+		}
+		matches = append(includes, matches...)
+	}
+	return files, errs.err()
+}
+
+// applyOverlay deep merges the overlay of opts.Env for f, if there is one,
+// into f. Jobs and other named list items are patched by name, see mergeNodes.
+func applyOverlay(f *jobFile, opts readOptions, marks origins) error {
+	if opts.Env == "" {
+		return nil
+	}
+	path := overlayPath(f.path, opts.Env)
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	overlay, err := readJobFile(path, opts)
+	if err != nil || overlay == nil {
+		return err
+	}
+	marks.mark(path, overlay.body, "overlay "+opts.Env)
+
+	base := mappingValue(f.body, "jobs")
+	f.body = mergeNodes(f.body, overlay.body)
+	// Patched jobs keep the position of their definition in the base file.
+	if jobs := mappingValue(f.body, "jobs"); jobs != nil && base != nil {
+		for _, n := range jobs.Content {
+			if b := namedItem(base, itemName(n)); b != nil {
+				n.Line, n.Column = b.Line, b.Column
+			}
+		}
+	}
+	f.root = root{}
+	err = removeDeleted(f.body).Decode(&f.root)
+	if err != nil {
+		return errors.Wrapf(err, "could not unmarshal %s", path)
+	}
+	return nil
+}
+
+// overlayPath returns the overlay of file for env, e.g. jobs.production.yml
+// for jobs.yml and jobs.production.yml.tmpl for jobs.yml.tmpl.
+func overlayPath(file, env string) string {
+	if isTemplateFile(file) {
+		return overlayPath(strings.TrimSuffix(file, templateExt), env) + templateExt
+	}
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "." + env + ext
+}
+
+func readJobFile(file string, opts readOptions) (*jobFile, error) {
 	var root root
 	bytes, err := os.ReadFile(file)
 	if err != nil {
 		return nil, errors.Errorf("could not load deployment yml file: %s", file)
 	}
-	err = yaml.Unmarshal(bytes, &root)
+	if opts.Template || isTemplateFile(file) {
+		bytes, err = renderTemplate(file, bytes, opts.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(bytes, &doc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s", file)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	body := doc.Content[0]
+	if errs := validateSchema(file, body, fileSchema, fileSchema.Defs, ""); len(errs) > 0 {
+		return nil, errs
+	}
+	if errs := checkNode(file, body, reflect.TypeOf(root)); len(errs) > 0 {
+		return nil, errs
+	}
+	decoded := removeDeleted(body)
+	takePlaceholders(decoded, reflect.TypeOf(root), "")
+	err = decoded.Decode(&root)
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not unmarshal yaml")
+		return nil, errors.Wrapf(err, "could not unmarshal %s", file)
 	}
+	return &jobFile{path: file, root: root, body: body}, nil
+}
 
-	return root.Jobs, nil
+// checkNode strictly checks n against the Go type t, reporting unknown keys and
+// values that cannot be decoded together with their position in file.
+func checkNode(file string, n *yaml.Node, t reflect.Type) errorList {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Tag == "!!null" || isDeleted(n) {
+		return nil
+	}
+	if holdsPlaceholder(n, t) {
+		return nil
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	pos := position{File: file, Line: n.Line, Column: n.Column}
+
+	if reflect.PointerTo(t).Implements(reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()) {
+		return checkDecode(pos, n, t)
+	}
+
+	var errs errorList
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return errorList{positionError{pos, fmt.Sprintf("expected a mapping, got %s", nodeKind(n))}}
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok {
+				errs = append(errs, positionError{position{file, key.Line, key.Column}, fmt.Sprintf("unknown field %q", key.Value)})
+				continue
+			}
+			errs = append(errs, checkNode(file, value, field.Type)...)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return errorList{positionError{pos, fmt.Sprintf("expected a mapping, got %s", nodeKind(n))}}
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			errs = append(errs, checkNode(file, n.Content[i+1], t.Elem())...)
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return errorList{positionError{pos, fmt.Sprintf("expected a list, got %s", nodeKind(n))}}
+		}
+		for _, item := range n.Content {
+			errs = append(errs, checkNode(file, item, t.Elem())...)
+		}
+	default:
+		return checkDecode(pos, n, t)
+	}
+	return errs
+}
+
+func checkDecode(pos position, n *yaml.Node, t reflect.Type) errorList {
+	err := n.Decode(reflect.New(t).Interface())
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		msg = strings.Join(typeErr.Errors, "; ")
+	}
+	msg = strings.TrimPrefix(msg, fmt.Sprintf("line %d: ", n.Line))
+	return errorList{positionError{pos, msg}}
+}
+
+// yamlFields maps the yaml keys of the struct type t to its fields.
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func nodeKind(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	default:
+		return fmt.Sprintf("%q", n.Value)
+	}
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func Test_ReadJobs(t *testing.T) {
@@ -17,3 +18,121 @@ func Test_ReadJobs(t *testing.T) {
 	_, err = readJobs("data/does_not_exist.yml")
 	require.Error(t, err)
 }
+
+func Test_ReadJobsDefaults(t *testing.T) {
+	jobs, err := readJobs("data/defaults.yml")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(jobs))
+
+	inherits := jobs[0]
+	require.Equal(t, "projects/test/locations/europe-west1/keyRings/test/cryptoKeys/test", inherits.EncryptionKey)
+	require.Equal(t, "gen1", inherits.ExecutionEnvironment)
+	require.Equal(t, "ga", inherits.LaunchStage)
+	require.Equal(t, "runner@test.iam.gserviceaccount.com", inherits.ServiceAccount)
+	require.Equal(t, "1Gi", inherits.Memory)
+	require.Equal(t, "Europe/Copenhagen", inherits.Timezone)
+	require.Equal(t, 2, *inherits.Trigger.RetryCount)
+	require.Nil(t, inherits.Trigger.AttemptDeadline)
+	require.Equal(t, map[string]string{"team": "data", "cost-center": "analytics"}, inherits.Labels)
+	require.Equal(t, []envVar{{Name: "LOG_LEVEL", Value: "info"}, {Name: "DB_PASSWORD", Secret: "db-password"}}, inherits.Env)
+	require.Equal(t, position{File: "data/defaults.yml", Line: 20, Column: 5}, inherits.pos)
+
+	overrides := jobs[1]
+	require.Equal(t, "projects/test/locations/europe-west1/keyRings/test/cryptoKeys/test", overrides.EncryptionKey)
+	require.Equal(t, "gen2", overrides.ExecutionEnvironment)
+	require.Equal(t, "beta", overrides.LaunchStage)
+	require.Equal(t, "2Gi", overrides.Memory)
+	require.Equal(t, 2, *overrides.Trigger.RetryCount)
+	require.Equal(t, duration(5*time.Minute), *overrides.Trigger.AttemptDeadline)
+	require.Equal(t, map[string]string{"team": "platform", "cost-center": "analytics"}, overrides.Labels)
+	require.Equal(t, []envVar{{Name: "LOG_LEVEL", Value: "debug"}, {Name: "DB_PASSWORD", Secret: "db-password"}, {Name: "EXTRA", Value: "1"}}, overrides.Env)
+
+	j := convertToRunJob("sa@test", inherits)
+	require.Equal(t, "europe-docker.pkg.dev/test/jobs/test", j.Image)
+}
+
+func Test_ReadJobsDefaultsCannotSetName(t *testing.T) {
+	_, err := readJobs("data/defaults_name.yml")
+	require.EqualError(t, err, `data/defaults_name.yml:2:3: defaults: unknown field "name"`)
+}
+
+func Test_ReadJobsStrict(t *testing.T) {
+	_, err := readJobs("data/invalid.yml")
+	require.Error(t, err)
+	require.Equal(t, `data/invalid.yml:4:5: jobs[0]: unknown field "servce_account"
+data/invalid.yml:7:12: jobs[1].tasks: expected integer or a placeholder, got "many"
+data/invalid.yml:8:14: jobs[1].timeout: invalid value "forever": Maximum duration of a task, in seconds or as a duration like 90m.
+data/invalid.yml:11:9: jobs[1].env[0]: unknown field "valu"`, err.Error())
+}
+
+func Test_ReadJobsPositions(t *testing.T) {
+	jobs, err := readJobs("data/test.yml")
+	require.NoError(t, err)
+	require.Equal(t, position{File: "data/test.yml", Line: 2, Column: 5}, jobs[0].pos)
+	require.Equal(t, position{File: "data/test.yml", Line: 6, Column: 5}, jobs[1].pos)
+}
+
+func Test_ReadJobsMultipleFiles(t *testing.T) {
+	jobs, err := readJobs("data/multi/jobs.yml", "data/multi/teams/**/*.yml")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(jobs))
+
+	require.Equal(t, "main", jobs[0].Name)
+	require.Equal(t, "exporter", jobs[0].Image)
+	require.Equal(t, map[string]string{"team": "core"}, jobs[0].Labels)
+	require.Equal(t, "data/multi/jobs.yml", jobs[0].pos.File)
+
+	require.Equal(t, "team-a", jobs[1].Name)
+	require.Equal(t, "exporter", jobs[1].Image)
+	require.Equal(t, "1Gi", jobs[1].Memory)
+	require.Nil(t, jobs[1].Labels)
+	require.Equal(t, "data/multi/teams/a/jobs.yml", jobs[1].pos.File)
+
+	require.Equal(t, "team-b", jobs[2].Name)
+	require.Equal(t, "data/multi/teams/b/jobs.yml", jobs[2].pos.File)
+
+	dir, err := readJobs("data/multi")
+	require.NoError(t, err)
+	require.Equal(t, jobs, dir)
+}
+
+func Test_ReadJobsDuplicatesAcrossFiles(t *testing.T) {
+	_, err := readJobs("data/duplicates/a.yml", "data/duplicates/c.yml", "data/duplicates/b.yml")
+	require.EqualError(t, err, `data/duplicates/b.yml:2:3: duplicate template "shared", first defined at data/duplicates/c.yml:2:3`)
+
+	jobs, err := readJobs("data/duplicates/a.yml", "data/duplicates/b.yml")
+	require.NoError(t, err)
+	require.EqualError(t, validateJobs(jobs), `data/duplicates/b.yml:5:5: job "export": duplicate job name, first defined at data/duplicates/a.yml:2:5`)
+}
+
+func Test_ReadJobsOverlay(t *testing.T) {
+	jobs, err := readJobs("data/overlays/jobs.yml")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(jobs))
+	require.Equal(t, "0 * * * *", jobs[0].Schedule)
+
+	jobs, err = readJobsWith(readOptions{Env: "production"}, "data/overlays")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(jobs))
+
+	export := jobs[0]
+	require.Equal(t, "export", export.Name)
+	require.Equal(t, "exporter", export.Image)
+	require.Equal(t, "0 3 * * *", export.Schedule)
+	require.Equal(t, "", export.Memory)
+	require.Equal(t, map[string]string{"team": "data", "tier": "critical"}, export.Labels)
+	require.Equal(t, []envVar{{Name: "LOG_LEVEL", Value: "info"}}, export.Env)
+	require.Equal(t, position{File: "data/overlays/jobs.yml", Line: 6, Column: 5}, export.pos)
+
+	require.Equal(t, "overlay production (data/overlays/jobs.production.yml:3:15)", export.origins["schedule"].String())
+	require.Equal(t, "overlay production (data/overlays/jobs.production.yml:9:16)", export.origins["env[LOG_LEVEL].value"].String())
+	require.Equal(t, "job (data/overlays/jobs.yml:7:12)", export.origins["image"].String())
+	require.Equal(t, "file default (data/overlays/jobs.yml:4:11)", export.origins["labels.team"].String())
+	require.Equal(t, []string{"env[LOG_LEVEL].value", "labels.tier", "schedule"}, overlayFields(export))
+}
+
+func Test_ReadJobsOverlayMissing(t *testing.T) {
+	jobs, err := readJobsWith(readOptions{Env: "staging"}, "data/overlays/jobs.yml")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(jobs))
+}
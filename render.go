@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// templateExt marks jobs files that are rendered as Go templates before they
+// are parsed, e.g. jobs.yml.tmpl.
+const templateExt = ".tmpl"
+
+func isTemplateFile(path string) bool {
+	return strings.HasSuffix(path, templateExt)
+}
+
+// renderTemplate executes src, the content of file, as a Go text/template with
+// data. Referencing a key missing from data is an error. Errors reported for
+// the rendered file refer to lines of the rendered output.
+func renderTemplate(file string, src []byte, data map[string]interface{}) ([]byte, error) {
+	t, err := texttemplate.New(filepath.Base(file)).
+		Option("missingkey=error").
+		Funcs(templateFuncs(filepath.Dir(file))).
+		Parse(string(src))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse template %s", file)
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	var out bytes.Buffer
+	err = t.Execute(&out, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not render template %s", file)
+	}
+	return out.Bytes(), nil
+}
+
+// templateFuncs returns the functions available to templates. Relative paths
+// are resolved against dir, the directory of the template.
+func templateFuncs(dir string) texttemplate.FuncMap {
+	path := func(name string) string {
+		if filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(dir, name)
+	}
+	return texttemplate.FuncMap{
+		"env": os.Getenv,
+		"requiredEnv": func(name string) (string, error) {
+			value, ok := os.LookupEnv(name)
+			if !ok || value == "" {
+				return "", errors.Errorf("environment variable %s is not set", name)
+			}
+			return value, nil
+		},
+		"default": func(fallback, value interface{}) interface{} {
+			if value == nil || value == "" {
+				return fallback
+			}
+			return value
+		},
+		"lower":   strings.ToLower,
+		"upper":   strings.ToUpper,
+		"title":   title,
+		"trim":    strings.TrimSpace,
+		"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"split":   func(sep, s string) []string { return strings.Split(s, sep) },
+		"join": func(sep string, items interface{}) (string, error) {
+			switch items := items.(type) {
+			case []string:
+				return strings.Join(items, sep), nil
+			case []interface{}:
+				parts := make([]string, len(items))
+				for i, item := range items {
+					parts[i] = fmt.Sprint(item)
+				}
+				return strings.Join(parts, sep), nil
+			}
+			return "", errors.Errorf("join: expected a list, got %T", items)
+		},
+		"quote":  strconv.Quote,
+		"indent": indent,
+		"list":   func(items ...interface{}) []interface{} { return items },
+		"readFile": func(name string) (string, error) {
+			b, err := os.ReadFile(path(name))
+			return string(b), err
+		},
+		"readYaml": func(name string) (interface{}, error) {
+			b, err := os.ReadFile(path(name))
+			if err != nil {
+				return nil, err
+			}
+			var v interface{}
+			err = yaml.Unmarshal(b, &v)
+			return v, errors.Wrapf(err, "could not parse %s", name)
+		},
+		"gitSha":    func() (string, error) { return gitSha(dir) },
+		"gitBranch": func() (string, error) { return gitBranch(dir) },
+	}
+}
+
+func title(s string) string {
+	if s == "" {
+		return s
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// indent prefixes every line of s with n spaces, e.g. to embed a file in a
+// block scalar.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// gitSha and gitBranch return the commit and the branch checked out in dir.
+// They are variables so tests do not depend on a git checkout.
+var (
+	gitSha = func(dir string) (string, error) {
+		return git(dir, "rev-parse", "HEAD")
+	}
+	gitBranch = func(dir string) (string, error) {
+		return git(dir, "rev-parse", "--abbrev-ref", "HEAD")
+	}
+)
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "git %s", strings.Join(args, " "))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// templateData returns the data templates are executed with: the values of
+// the --var-file files followed by the --var flags.
+func templateData(args args) (map[string]interface{}, error) {
+	data, err := loadVarFiles(args.VarFiles)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range args.Vars {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid --var %q, expected name=value", v)
+		}
+		data[name] = value
+	}
+	return data, nil
+}
+
+// loadVarFiles merges the top-level values of the given YAML files, later
+// files take precedence.
+func loadVarFiles(files []string) (map[string]interface{}, error) {
+	vars := map[string]interface{}{}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read var file %s", file)
+		}
+		var fileVars map[string]interface{}
+		err = yaml.Unmarshal(b, &fileVars)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not unmarshal var file %s", file)
+		}
+		for k, v := range fileVars {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// renderFiles prints the jobs files as they are parsed, after rendering the
+// templates among them.
+func renderFiles(args args) error {
+	files, err := renderSources(args)
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Printf("# %s\n%s", f.path, f.src)
+		if len(f.src) > 0 && f.src[len(f.src)-1] != '\n' {
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+// renderedFile is a jobs file after rendering.
+type renderedFile struct {
+	path string
+	src  []byte
+}
+
+// renderSources renders the jobs files of args followed by the files they
+// include, in the order loadJobFiles reads them. Every file is rendered once.
+func renderSources(args args) ([]renderedFile, error) {
+	data, err := templateData(args)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := expandPaths(args.FileNames, "", args.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []renderedFile
+	loaded := map[string]bool{}
+	for len(matches) > 0 {
+		file := matches[0]
+		matches = matches[1:]
+		if loaded[file] {
+			continue
+		}
+		loaded[file] = true
+
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Errorf("could not load deployment yml file: %s", file)
+		}
+		if args.Template || isTemplateFile(file) {
+			src, err = renderTemplate(file, src, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		files = append(files, renderedFile{file, src})
+
+		var r struct{ Include []string }
+		err = yaml.Unmarshal(src, &r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse %s", file)
+		}
+		includes, err := expandPaths(r.Include, filepath.Dir(file), args.Env)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: include", file)
+		}
+		matches = append(includes, matches...)
+	}
+	return files, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// stubGit makes gitSha and gitBranch return fixed values for the test.
+func stubGit(t *testing.T, sha, branch string) {
+	oldSha, oldBranch := gitSha, gitBranch
+	gitSha = func(string) (string, error) { return sha, nil }
+	gitBranch = func(string) (string, error) { return branch, nil }
+	t.Cleanup(func() { gitSha, gitBranch = oldSha, oldBranch })
+}
+
+func Test_ReadJobsTemplate(t *testing.T) {
+	stubGit(t, "0123456789abcdef0123456789abcdef01234567", "release")
+	data, err := templateData(args{VarFiles: []string{"data/render/customers.vars.yml"}})
+	require.NoError(t, err)
+
+	jobs, err := readJobsWith(readOptions{Data: data}, "data/render/jobs.yml.tmpl")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(jobs))
+	require.Equal(t, "export-acme", jobs[0].Name)
+	require.Equal(t, "export-globex", jobs[1].Name)
+	require.Contains(t, jobs[1].Args, "--customer Globex --branch release")
+	require.Equal(t, map[string]string{"region": "eu"}, jobs[1].Labels)
+	require.Equal(t, []envVar{{Name: "MOTD", Value: "hello"}}, jobs[2].Env)
+
+	_, err = readJobsWith(readOptions{}, "data/render/missing.yml.tmpl")
+	require.ErrorContains(t, err, `could not render template data/render/missing.yml.tmpl`)
+	require.ErrorContains(t, err, `map has no entry for key "name"`)
+}
+
+func Test_RenderSources(t *testing.T) {
+	files, err := renderSources(args{FileNames: []string{"data/multi/jobs.yml"}})
+	require.NoError(t, err)
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	require.Equal(t, []string{"data/multi/jobs.yml", "data/multi/shared/templates.yml"}, paths)
+}
+
+func Test_TemplateFuncs(t *testing.T) {
+	out, err := renderTemplate("test.tmpl", []byte(`{{ split "," "a,b" | join "-" }} {{ list 1 2 | join "+" }} {{ indent 2 "a\nb" }} {{ upper "x" }}`), nil)
+	require.NoError(t, err)
+	require.Equal(t, "a-b 1+2   a\n  b X", string(out))
+
+	out, err = renderTemplate("test.tmpl", []byte(`[{{ title "" }}] {{ title "émile" }}`), nil)
+	require.NoError(t, err)
+	require.Equal(t, "[] Émile", string(out))
+
+	stubGit(t, "0123456789abcdef0123456789abcdef01234567", "main")
+	sha, err := renderTemplate("data/test.tmpl", []byte(`{{ gitSha }} {{ gitBranch }}`), nil)
+	require.NoError(t, err)
+	require.Equal(t, "0123456789abcdef0123456789abcdef01234567 main", string(sha))
+}
@@ -8,9 +8,30 @@ import (
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"time"
 )
 
 func deleteSchedulerJobs(c *service, validTriggerNames []string) error {
+	ctx := context.Background()
+	names, err := staleSchedulerJobs(c, validTriggerNames)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		log.Debug().Msgf("deleting trigger %s ", name)
+		err := c.cscclient.DeleteJob(ctx, &schedulerpb.DeleteJobRequest{Name: name})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleSchedulerJobs returns the resource names of the triggers that are no
+// longer defined in validTriggerNames.
+func staleSchedulerJobs(c *service, validTriggerNames []string) ([]string, error) {
 	ctx := context.Background()
 	iter := c.cscclient.ListJobs(ctx, &schedulerpb.ListJobsRequest{
 		Parent:    c.parent(),
@@ -18,30 +39,25 @@ func deleteSchedulerJobs(c *service, validTriggerNames []string) error {
 		PageToken: "",
 	})
 
+	var names []string
 	for {
 		res, err := iter.Next()
 		if err != nil {
 			if err == iterator.Done {
 				break
 			}
-			return err
+			return nil, err
 		}
 
 		if !pie.Contains(validTriggerNames, trimParent(c.parent(), res.Name)) {
-			log.Debug().Msgf("deleting trigger %s ", res.Name)
-			err := c.cscclient.DeleteJob(ctx, &schedulerpb.DeleteJobRequest{Name: res.Name})
-			if err != nil {
-				return err
-			}
+			names = append(names, res.Name)
 		}
 	}
-	return nil
+	return names, nil
 }
 
 func handleSchedulerJob(c *service, j job) error {
 	ctx := context.Background()
-	var update bool
-	uri := triggerUri(c.project, c.region, j.Name)
 
 	scheduledJob, err := c.getOrCreateSchedulerJob(ctx, j)
 	if err != nil {
@@ -63,44 +79,77 @@ func handleSchedulerJob(c *service, j job) error {
 		}
 	}
 
+	update, err := updateSchedulerJob(c, scheduledJob, j)
+	if err != nil {
+		return err
+	}
+
+	if len(update) > 0 {
+		log.Debug().Msgf("Updating trigger: %s - %s", scheduledJob.Name, scheduledJob.State)
+		_, err := c.cscclient.UpdateJob(ctx, &schedulerpb.UpdateJobRequest{
+			Job: scheduledJob,
+			//UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"schedule", "http_target.uri", "time_zone", "state"}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateSchedulerJob aligns scheduledJob with j and returns the names of the
+// fields that changed.
+func updateSchedulerJob(c *service, scheduledJob *schedulerpb.Job, j job) ([]string, error) {
+	var update []string
+	uri := triggerUri(c.project, c.region, j.Name)
+
 	if scheduledJob.Schedule != j.Schedule {
 		log.Debug().Msgf("Updating schedule for trigger %s from %s to %s", scheduledJob.Name, scheduledJob.Schedule, j.Schedule)
 		scheduledJob.Schedule = j.Schedule
-		update = true
+		update = append(update, "schedule")
 	}
 
-	if scheduledJob.TimeZone != defaultTimezone {
-		log.Debug().Msgf("Updating timezone for trigger %s from %s to %s", scheduledJob.Name, scheduledJob.TimeZone, defaultTimezone)
-		scheduledJob.TimeZone = defaultTimezone
-		update = true
+	if scheduledJob.TimeZone != j.Timezone {
+		log.Debug().Msgf("Updating timezone for trigger %s from %s to %s", scheduledJob.Name, scheduledJob.TimeZone, j.Timezone)
+		scheduledJob.TimeZone = j.Timezone
+		update = append(update, "time_zone")
 	}
 
 	target, ok := scheduledJob.Target.(*schedulerpb.Job_HttpTarget)
 	if !ok {
-		return errors.Errorf("bad target for trigger %s", scheduledJob.Name)
+		return nil, errors.Errorf("bad target for trigger %s", scheduledJob.Name)
 	}
 
 	if target.HttpTarget.Uri != uri {
 		log.Debug().Msgf("Updating url for trigger %s from %s to %s", scheduledJob.Name, target.HttpTarget.Uri, uri)
-		scheduledJob.Target = targetFromUri(c.defaultServiceAccount, uri)
-		update = true
+		scheduledJob.Target = targetFromUri(c.triggerAccount(j), uri)
+		update = append(update, "http_target.uri")
+	} else if account := c.triggerAccount(j); target.HttpTarget.GetOauthToken().GetServiceAccountEmail() != account {
+		log.Debug().Msgf("Updating service account for trigger %s from %s to %s", scheduledJob.Name, target.HttpTarget.GetOauthToken().GetServiceAccountEmail(), account)
+		scheduledJob.Target = targetFromUri(account, uri)
+		update = append(update, "http_target.oauth_token.service_account_email")
 	}
 
-	if update {
-		log.Debug().Msgf("Updating trigger: %s - %s", scheduledJob.Name, scheduledJob.State)
-		_, err := c.cscclient.UpdateJob(ctx, &schedulerpb.UpdateJobRequest{
-			Job: scheduledJob,
-			//UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"schedule", "http_target.uri", "time_zone", "state"}},
-		})
-		if err != nil {
-			return err
+	if j.Trigger != nil && j.Trigger.RetryCount != nil && scheduledJob.RetryConfig.GetRetryCount() != int32(*j.Trigger.RetryCount) {
+		log.Debug().Msgf("Updating retry count for trigger %s from %d to %d", scheduledJob.Name, scheduledJob.RetryConfig.GetRetryCount(), *j.Trigger.RetryCount)
+		if scheduledJob.RetryConfig == nil {
+			scheduledJob.RetryConfig = &schedulerpb.RetryConfig{}
 		}
+		scheduledJob.RetryConfig.RetryCount = int32(*j.Trigger.RetryCount)
+		update = append(update, "retry_config.retry_count")
 	}
-	return nil
+
+	if j.Trigger != nil && j.Trigger.AttemptDeadline != nil && scheduledJob.AttemptDeadline.AsDuration() != time.Duration(*j.Trigger.AttemptDeadline) {
+		log.Debug().Msgf("Updating attempt deadline for trigger %s from %s to %s", scheduledJob.Name, scheduledJob.AttemptDeadline.AsDuration(), time.Duration(*j.Trigger.AttemptDeadline))
+		scheduledJob.AttemptDeadline = durationpb.New(time.Duration(*j.Trigger.AttemptDeadline))
+		update = append(update, "attempt_deadline")
+	}
+
+	return update, nil
 }
 
 func getSchedulerResourceName(project, region, jobName string) string {
-	return fmt.Sprintf("projects/%s/locations/%s/jobs/%s-trigger", project, region, jobName)
+	return fmt.Sprintf("projects/%s/locations/%s/jobs/%s", project, region, jobName+triggerSuffix)
 }
 
 func (c *service) getOrCreateSchedulerJob(ctx context.Context, j job) (*schedulerpb.Job, error) {
@@ -117,24 +166,9 @@ func (c *service) getSchedulerJob(ctx context.Context, jobName string) (*schedul
 }
 
 func (c *service) createSchedulerJob(ctx context.Context, j job) (*schedulerpb.Job, error) {
-	name := getSchedulerResourceName(c.project, c.region, j.Name)
-	uri := triggerUri(c.project, c.region, j.Name)
 	res, err := c.cscclient.CreateJob(ctx, &schedulerpb.CreateJobRequest{
 		Parent: fmt.Sprintf("projects/%s/locations/%s", c.project, c.region),
-		Job: &schedulerpb.Job{
-			Name:            name,
-			Description:     fmt.Sprintf("Trigger for %s (created by gruns)", j.Name),
-			Target:          targetFromUri(c.defaultTriggerAccount, uri),
-			Schedule:        j.Schedule,
-			TimeZone:        defaultTimezone,
-			UserUpdateTime:  nil,
-			State:           schedulerpb.Job_ENABLED,
-			Status:          nil,
-			ScheduleTime:    nil,
-			LastAttemptTime: nil,
-			RetryConfig:     nil,
-			AttemptDeadline: nil,
-		},
+		Job:    c.newSchedulerJob(j),
 	})
 
 	if err != nil {
@@ -146,6 +180,55 @@ func (c *service) createSchedulerJob(ctx context.Context, j job) (*schedulerpb.J
 	return res, nil
 }
 
+// newSchedulerJob returns the trigger of j as it is created.
+func (c *service) newSchedulerJob(j job) *schedulerpb.Job {
+	return &schedulerpb.Job{
+		Name:            getSchedulerResourceName(c.project, c.region, j.Name),
+		Description:     fmt.Sprintf("Trigger for %s (created by gruns)", j.Name),
+		Target:          targetFromUri(c.triggerAccount(j), triggerUri(c.project, c.region, j.Name)),
+		Schedule:        j.Schedule,
+		TimeZone:        j.Timezone,
+		UserUpdateTime:  nil,
+		State:           schedulerpb.Job_ENABLED,
+		Status:          nil,
+		ScheduleTime:    nil,
+		LastAttemptTime: nil,
+		RetryConfig:     retryConfig(j.Trigger),
+		AttemptDeadline: attemptDeadline(j.Trigger),
+	}
+}
+
+// jobAccount returns the service account j runs as.
+func (c *service) jobAccount(j job) string {
+	if j.ServiceAccount != "" {
+		return j.ServiceAccount
+	}
+	return c.defaultServiceAccount
+}
+
+// triggerAccount returns the service account the trigger of j authenticates
+// as.
+func (c *service) triggerAccount(j job) string {
+	if j.Trigger != nil && j.Trigger.ServiceAccount != "" {
+		return j.Trigger.ServiceAccount
+	}
+	return c.defaultTriggerAccount
+}
+
+func retryConfig(t *trigger) *schedulerpb.RetryConfig {
+	if t == nil || t.RetryCount == nil {
+		return nil
+	}
+	return &schedulerpb.RetryConfig{RetryCount: int32(*t.RetryCount)}
+}
+
+func attemptDeadline(t *trigger) *durationpb.Duration {
+	if t == nil || t.AttemptDeadline == nil {
+		return nil
+	}
+	return durationpb.New(time.Duration(*t.AttemptDeadline))
+}
+
 func triggerUri(project, region, name string) string {
 	return fmt.Sprintf("https://%s-run.googleapis.com/apis/run.googleapis.com/v1/namespaces/%s/jobs/%s:run", region, project, name)
 }
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const schemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// placeholderPattern matches the strings holding a ${...} placeholder.
+const placeholderPattern = `\$\{`
+
+// jsonSchema is the subset of JSON Schema used to describe jobs.yml.
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 interface{}            `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Minimum              *int                   `json:"minimum,omitempty"`
+	Maximum              *int                   `json:"maximum,omitempty"`
+	Default              interface{}            `json:"default,omitempty"`
+	Defs                 map[string]*jsonSchema `json:"$defs,omitempty"`
+
+	// ignoreCase accepts the values of Enum in any case.
+	ignoreCase bool
+	// re is the compiled Pattern.
+	re *regexp.Regexp
+}
+
+// MarshalJSON adds the uppercase variants to the enums that ignore case, as
+// JSON Schema has no case-insensitive enum.
+func (s jsonSchema) MarshalJSON() ([]byte, error) {
+	type plain jsonSchema
+	p := plain(s)
+	if s.ignoreCase {
+		p.Enum = append([]string{}, s.Enum...)
+		for _, v := range s.Enum {
+			if upper := strings.ToUpper(v); upper != v {
+				p.Enum = append(p.Enum, upper)
+			}
+		}
+	}
+	return json.Marshal(p)
+}
+
+// schemaFields documents the fields of the jobs.yml model, keyed by
+// "<type>.<yaml key>". Patterns also accept ${...} placeholders because they
+// are checked before interpolation.
+var schemaFields = map[string]jsonSchema{
+	"root.include":          {Description: "Paths, globs or directories of other jobs files to load, relative to this file."},
+	"root.vars":             {Description: "Variables referenced as ${NAME} by the jobs of this file. --var and --var-file take precedence."},
+	"root.env_groups":       {Description: "Named lists of environment variables shared by jobs, referenced with env_groups."},
+	"root.defaults":         {Description: "Settings applied to every job that does not set them itself."},
+	"root.templates":        {Description: "Named settings shared by families of jobs, inherited with extends."},
+	"root.secrets":          {Description: "Secret Manager secrets whose content gruns keeps in sync with SOPS encrypted files."},
+	"root.service_accounts": {Description: "Service accounts gruns creates and owns. Jobs and triggers refer to them by name. Accounts gruns created that are no longer declared or used are deleted."},
+	"root.image_policy":     {Description: "Rules the image of every job must follow, checked after interpolation. Set it in an environment overlay to apply it to that environment only."},
+	"root.jobs":             {Description: "The Cloud Run jobs managed by gruns."},
+
+	"job.matrix":                 {Description: "Values the job is expanded with: one job per combination, with ${matrix.<key>} replaced by the values of the combination. The name must reference the matrix so that every job gets its own."},
+	"job.description":            {Description: "What the job does, for the readers of the jobs file. It is not deployed."},
+	"job.extends":                {Description: "Name of the template the job inherits its settings from. Templates may extend other templates."},
+	"job.registry":               {Description: "Registry prefix added to image when the image does not name a registry itself, e.g. europe-docker.pkg.dev/${PROJECT_ID}/jobs."},
+	"job.timezone":               {Description: "Time zone of the schedule.", Default: defaultTimezone},
+	"job.trigger":                {Description: "Cloud Scheduler settings of the trigger."},
+	"job.labels":                 {Description: "Labels added to the Cloud Run job."},
+	"job.roles":                  {Description: "Roles granted to the service account of the job on the project. apply also grants roles/run.invoker on the job to the trigger account and roles/secretmanager.secretAccessor on the referenced secrets to the service account, and removes the bindings it added once no job needs them.", Items: &jsonSchema{Type: "string", Pattern: orPlaceholder(roleRegex)}},
+	"job.name":                   {Description: "Name of the Cloud Run job: lowercase letters, digits and hyphens, starting with a letter. The trigger is named <name>" + triggerSuffix + ".", Pattern: orPlaceholder(jobNameRegex)},
+	"job.service_account":        {Description: "Service account the job runs as. Defaults to the --service-account flag or the default compute account."},
+	"job.parallelism":            {Description: "Maximum number of tasks running at the same time, 0 for no limit.", Minimum: ptr(0), Default: defaultParallelism},
+	"job.tasks":                  {Description: "Number of tasks per execution.", Minimum: ptr(1), Maximum: ptr(maxTasks), Default: defaultTasks},
+	"job.retries":                {Description: "Number of retries per failed task.", Minimum: ptr(0), Maximum: ptr(maxRetries), Default: defaultRetries},
+	"job.timeout":                {Description: "Maximum duration of a task, in seconds or as a duration like 90m.", Default: int(defaultTimeout.Seconds())},
+	"job.image":                  {Description: "Container image to run."},
+	"job.schedule":               {Description: "Cron schedule of the trigger. Jobs without a schedule get no trigger."},
+	"job.args":                   {Description: "Space separated arguments passed to the container."},
+	"job.cpu":                    {Description: "CPU limit, e.g. 1000m or 2.", Default: defaultCpu},
+	"job.memory":                 {Description: "Memory limit, e.g. 512Mi or 2Gi.", Default: defaultMem},
+	"job.env":                    {Description: "Environment variables of the container. They take precedence over the env groups and the env file."},
+	"job.env_from_secret":        {Description: "Secret Manager secrets holding a JSON object, expanded into one environment variable per top-level key at apply time. Variables set in env take precedence."},
+	"job.env_groups":             {Description: "Names of the env groups whose variables are added to the container. They take precedence over the env file."},
+	"job.env_file":               {Description: "Dotenv file, relative to the jobs file, whose variables are added to the container as literal values."},
+	"job.encryption_key":         {Description: "Customer managed KMS key used to encrypt the job, projects/*/locations/*/keyRings/*/cryptoKeys/*.", Pattern: orPlaceholder(encryptionKeyRegex)},
+	"job.execution_environment":  {Description: "Execution environment of the tasks, in any case.", Enum: pie.Sort(pie.Keys(executionEnvironments)), ignoreCase: true, Default: defaultExecutionEnvironment},
+	"job.launch_stage":           {Description: "Launch stage of the job, in any case.", Enum: pie.Sort(pie.Keys(launchStages)), ignoreCase: true, Default: defaultLaunchStage},
+	"job.binary_authorization":   {Description: "Binary Authorization settings of the job."},
+	"job.image_policy_exemption": {Description: "Rules of the image policy the job is exempted from, with the reason. Exemptions are reported by plan and apply."},
+
+	"trigger.service_account":  {Description: "Service account the trigger authenticates as. Defaults to the trigger service account."},
+	"trigger.retry_count":      {Description: "Number of times the trigger retries a failed run request.", Minimum: ptr(0), Maximum: ptr(5)},
+	"trigger.attempt_deadline": {Description: "Deadline of a run request, in seconds or as a duration like 90s."},
+
+	"binaryAuthorization.use_default":              {Description: "Enforce the project's default Binary Authorization policy."},
+	"binaryAuthorization.policy":                   {Description: "Full name of the platform policy to enforce, projects/*/platforms/cloudRun/*.", Pattern: orPlaceholder(binauthzPolicyRegex)},
+	"binaryAuthorization.breakglass_justification": {Description: "Justification for bypassing the policy."},
+
+	"envFromSecret.secret":         {Description: "Secret Manager secret id or full name of the JSON secret.", Pattern: orPlaceholder(secretRegex)},
+	"envFromSecret.secret_version": {Description: "Version of the JSON secret, latest or a version number.", Pattern: `^(latest|[1-9][0-9]*)$`, Default: "latest"},
+	"envFromSecret.prefix":         {Description: "Prefix of the variable names, which are the upper cased keys of the JSON object."},
+	"envFromSecret.mode":           {Description: "references stores every key in a secret of its own, <secret>-<key>, referenced by the job. values sets the values as plain environment variables, visible to anyone who can read the job.", Enum: []string{envFromSecretReferences, envFromSecretValues}, Default: envFromSecretReferences},
+
+	"managedSecret.name": {Description: "Secret Manager secret id. Env vars referencing the secret without a secret_version are pinned to the version holding the content of the file.", Pattern: secretIdRegex.String()},
+	"managedSecret.file": {Description: "YAML file encrypted with SOPS and age, relative to the jobs file. The age keys are read from SOPS_AGE_KEY or SOPS_AGE_KEY_FILE."},
+	"managedSecret.key":  {Description: "Top-level key of the decrypted file holding the content of the secret. Without a key the secret holds the whole file as a JSON object."},
+
+	"serviceAccount.name":         {Description: "Account id of the service account, 6 to 30 lowercase letters, digits and hyphens. The email is <name>@<project>.iam.gserviceaccount.com.", Pattern: serviceAccountIdRegex.String()},
+	"serviceAccount.display_name": {Description: "Display name of the service account."},
+	"serviceAccount.description":  {Description: "Description of the service account. gruns appends a marker recording that it owns the account."},
+	"serviceAccount.roles":        {Description: "Roles granted to the service account on the project. Other project roles of the account are removed.", Items: &jsonSchema{Type: "string", Pattern: roleRegex.String()}},
+
+	"imagePolicy.allowed_registries": {Description: "Registries or repository prefixes the images must come from, e.g. europe-docker.pkg.dev/my-project/jobs. Images without a registry are on docker.io."},
+	"imagePolicy.forbid_latest":      {Description: "Reject images tagged latest or without a tag, unless they are pinned by digest."},
+	"imagePolicy.require_digest":     {Description: "Require images pinned by digest, <image>@sha256:<digest>."},
+
+	"imagePolicyExemption.rules":  {Description: "Rules the job is exempted from.", Items: &jsonSchema{Type: "string", Enum: imageRules}},
+	"imagePolicyExemption.reason": {Description: "Why the job is exempted."},
+
+	"envVar.name":           {Description: "Name of the environment variable: letters, digits and underscores, not starting with a digit.", Pattern: envNameRegex.String()},
+	"envVar.value":          {Description: "Literal value. Mutually exclusive with secret."},
+	"envVar.secret":         {Description: "Secret Manager secret id or full name. Mutually exclusive with value.", Pattern: orPlaceholder(secretRegex)},
+	"envVar.secret_version": {Description: "Version of the secret, latest or a version number.", Pattern: `^(latest|[1-9][0-9]*)$`, Default: "latest"},
+}
+
+// schemaTypes overrides the schema of types that have a custom yaml encoding.
+var schemaTypes = map[reflect.Type]jsonSchema{
+	reflect.TypeOf(duration(0)): {Type: []string{"integer", "string"}, Pattern: `^[0-9]+$|^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$|\$\{`},
+}
+
+// schemaOmitted lists keys that exist in the Go type but are not accepted in
+// jobs.yml.
+var schemaOmitted = map[string]bool{
+	"jobDefaults.name":    true,
+	"jobDefaults.extends": true,
+	"jobDefaults.matrix":  true,
+	"jobTemplate.name":    true,
+}
+
+// schemaRequired lists the required keys per type.
+var schemaRequired = map[string][]string{
+	"job":                  {"name"},
+	"envVar":               {"name"},
+	"envFromSecret":        {"secret"},
+	"managedSecret":        {"name", "file"},
+	"serviceAccount":       {"name"},
+	"imagePolicyExemption": {"rules", "reason"},
+}
+
+// jobsSchema generates the JSON Schema of jobs.yml from the model.
+func jobsSchema() *jsonSchema {
+	defs := map[string]*jsonSchema{}
+	schemaFor(reflect.TypeOf(root{}), defs)
+	s := defs["root"]
+	delete(defs, "root")
+	s.Schema = schemaDraft
+	s.Title = "gruns jobs.yml"
+	s.Description = "Cloud Run jobs and triggers managed by gruns."
+	s.Defs = defs
+	s.compilePatterns()
+	return s
+}
+
+// compilePatterns compiles the patterns of s and of the schemas below it.
+func (s *jsonSchema) compilePatterns() {
+	if s.Pattern != "" {
+		s.re = regexp.MustCompile(s.Pattern)
+	}
+	for _, p := range s.Properties {
+		p.compilePatterns()
+	}
+	for _, d := range s.Defs {
+		d.compilePatterns()
+	}
+	if s.Items != nil {
+		s.Items.compilePatterns()
+	}
+	if additional, ok := s.AdditionalProperties.(*jsonSchema); ok {
+		additional.compilePatterns()
+	}
+}
+
+func schemaFor(t reflect.Type, defs map[string]*jsonSchema) *jsonSchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if s, ok := schemaTypes[t]; ok {
+		return &s
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := defs[name]; !ok {
+			s := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}, AdditionalProperties: false, Required: schemaRequired[name]}
+			defs[name] = s
+			for key, f := range yamlFields(t) {
+				if schemaOmitted[name+"."+key] {
+					continue
+				}
+				field := schemaFor(f.Type, defs)
+				if doc, ok := schemaFields[name+"."+key]; ok {
+					field = mergeSchema(field, doc)
+				} else if doc, ok := schemaFields["job."+key]; ok && (name == "jobDefaults" || name == "jobTemplate") {
+					doc.Default = nil
+					field = mergeSchema(field, doc)
+				}
+				s.Properties[key] = field
+			}
+		}
+		return &jsonSchema{Ref: "#/$defs/" + name}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: schemaFor(t.Elem(), defs)}
+	case reflect.Slice:
+		return &jsonSchema{Type: "array", Items: schemaFor(t.Elem(), defs)}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		// Strings hold placeholders, which are interpolated before the
+		// value is decoded.
+		return &jsonSchema{Type: []string{"integer", "string"}, Pattern: placeholderPattern}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	default:
+		return &jsonSchema{Type: "string"}
+	}
+}
+
+// mergeSchema adds the documentation in doc to the generated schema s.
+func mergeSchema(s *jsonSchema, doc jsonSchema) *jsonSchema {
+	merged := *s
+	merged.Description = doc.Description
+	if doc.Pattern != "" {
+		merged.Pattern = doc.Pattern
+	}
+	if doc.Enum != nil {
+		merged.Enum = doc.Enum
+		merged.ignoreCase = doc.ignoreCase
+	}
+	if doc.Minimum != nil {
+		merged.Minimum = doc.Minimum
+	}
+	if doc.Maximum != nil {
+		merged.Maximum = doc.Maximum
+	}
+	if doc.Default != nil {
+		merged.Default = doc.Default
+	}
+	if doc.Items != nil {
+		merged.Items = doc.Items
+	}
+	return &merged
+}
+
+func orPlaceholder(re *regexp.Regexp) string {
+	return `^(` + strings.TrimSuffix(strings.TrimPrefix(re.String(), "^"), "$") + `)$|\$\{`
+}
+
+func printSchema() error {
+	b, err := json.MarshalIndent(jobsSchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// validateSchema checks the yaml document n of file against s, returning every
+// violation with its position.
+func validateSchema(file string, n *yaml.Node, s *jsonSchema, defs map[string]*jsonSchema, path string) errorList {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if s.Ref != "" {
+		return validateSchema(file, n, defs[strings.TrimPrefix(s.Ref, "#/$defs/")], defs, path)
+	}
+	failAt := func(n *yaml.Node, format string, a ...interface{}) errorList {
+		msg := fmt.Sprintf(format, a...)
+		if path != "" {
+			msg = path + ": " + msg
+		}
+		return errorList{positionError{position{File: file, Line: n.Line, Column: n.Column}, msg}}
+	}
+	fail := func(format string, a ...interface{}) errorList {
+		return failAt(n, format, a...)
+	}
+	if n.Tag == "!!null" || isDeleted(n) {
+		return nil
+	}
+
+	if !schemaTypeMatches(s.Type, n) {
+		return fail("expected %s, got %s", schemaTypeName(s.Type), nodeKind(n))
+	}
+
+	var errs errorList
+	switch n.Kind {
+	case yaml.MappingNode:
+		seen := map[string]bool{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			seen[key.Value] = true
+			prop, ok := s.Properties[key.Value]
+			if !ok {
+				if additional, ok := s.AdditionalProperties.(*jsonSchema); ok {
+					prop = additional
+				} else if s.AdditionalProperties == false {
+					errs = append(errs, failAt(key, "unknown field %q", key.Value)...)
+					continue
+				} else {
+					continue
+				}
+			}
+			errs = append(errs, validateSchema(file, value, prop, defs, joinPath(path, key.Value))...)
+		}
+		for _, r := range s.Required {
+			if !seen[r] {
+				errs = append(errs, fail("missing required field %q", r)...)
+			}
+		}
+	case yaml.SequenceNode:
+		if s.Items != nil {
+			for i, item := range n.Content {
+				errs = append(errs, validateSchema(file, item, s.Items, defs, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case yaml.ScalarNode:
+		if len(s.Enum) > 0 && !pie.Any(s.Enum, func(v string) bool { return v == n.Value || s.ignoreCase && strings.EqualFold(v, n.Value) }) {
+			return fail("%q is not one of %s", n.Value, strings.Join(s.Enum, ", "))
+		}
+		// As in JSON Schema, patterns only apply to strings. Fields of type
+		// string accept any scalar though.
+		if s.re != nil && (n.ShortTag() == "!!str" || s.Type == "string") && !s.re.MatchString(n.Value) {
+			if s.Pattern == placeholderPattern {
+				return fail("expected integer or a placeholder, got %q", n.Value)
+			}
+			if s.Description != "" {
+				return fail("invalid value %q: %s", n.Value, s.Description)
+			}
+			return fail("%q does not match %s", n.Value, s.Pattern)
+		}
+		if s.Minimum != nil || s.Maximum != nil {
+			if v, err := strconv.Atoi(n.Value); err == nil {
+				if s.Minimum != nil && v < *s.Minimum {
+					return fail("%d is less than the minimum of %d", v, *s.Minimum)
+				}
+				if s.Maximum != nil && v > *s.Maximum {
+					return fail("%d is greater than the maximum of %d", v, *s.Maximum)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func schemaTypeMatches(t interface{}, n *yaml.Node) bool {
+	var types []string
+	switch t := t.(type) {
+	case string:
+		types = []string{t}
+	case []string:
+		types = t
+	default:
+		return true
+	}
+	for _, t := range types {
+		switch t {
+		case "object":
+			if n.Kind == yaml.MappingNode {
+				return true
+			}
+		case "array":
+			if n.Kind == yaml.SequenceNode {
+				return true
+			}
+		case "string":
+			// yaml decodes any scalar into a string, so numbers and booleans
+			// are accepted as well.
+			if n.Kind == yaml.ScalarNode {
+				return true
+			}
+		case "integer":
+			if n.Kind == yaml.ScalarNode && n.ShortTag() == "!!int" {
+				return true
+			}
+		case "number":
+			if n.Kind == yaml.ScalarNode && (n.ShortTag() == "!!int" || n.ShortTag() == "!!float") {
+				return true
+			}
+		case "boolean":
+			if n.Kind == yaml.ScalarNode && n.ShortTag() == "!!bool" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func schemaTypeName(t interface{}) string {
+	switch t := t.(type) {
+	case []string:
+		sorted := append([]string(nil), t...)
+		sort.Strings(sorted)
+		return strings.Join(sorted, " or ")
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
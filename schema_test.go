@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"testing"
+)
+
+func Test_JobsSchema(t *testing.T) {
+	s := jobsSchema()
+	require.Equal(t, schemaDraft, s.Schema)
+	require.Equal(t, "#/$defs/job", s.Properties["jobs"].Items.Ref)
+
+	j := s.Defs["job"]
+	require.Equal(t, []string{"name"}, j.Required)
+	require.Equal(t, false, j.AdditionalProperties)
+	require.Equal(t, defaultMem, j.Properties["memory"].Default)
+	require.Equal(t, 900, j.Properties["timeout"].Default)
+	require.Contains(t, j.Properties["launch_stage"].Enum, "ga")
+	require.NotEmpty(t, j.Properties["name"].Pattern)
+	for key, p := range j.Properties {
+		require.NotEmpty(t, p.Description, key)
+	}
+
+	for key, p := range s.Properties {
+		require.NotEmpty(t, p.Description, key)
+	}
+
+	b, err := json.Marshal(s)
+	require.NoError(t, err)
+	var published struct {
+		Defs map[string]struct {
+			Properties map[string]struct {
+				Enum []string
+			}
+		} `json:"$defs"`
+	}
+	require.NoError(t, json.Unmarshal(b, &published))
+	require.Equal(t, []string{"alpha", "beta", "ga", "ALPHA", "BETA", "GA"}, published.Defs["job"].Properties["launch_stage"].Enum)
+	require.Equal(t, []string{"gen1", "gen2", "GEN1", "GEN2"}, published.Defs["job"].Properties["execution_environment"].Enum)
+}
+
+func Test_ValidateSchema(t *testing.T) {
+	tests := map[string]string{
+		"jobs: [{name: test, image: test}]":                            "",
+		"jobs: [{name: test, image: test, timeout: 1h30m}]":            "",
+		`jobs: [{name: "test-${PROJECT_ID}", image: test}]`:            "",
+		"jobs: [{image: test}]":                                        `jobs.yml:1:8: jobs[0]: missing required field "name"`,
+		"jobs: [{name: test, launch_stage: stable}]":                   `jobs.yml:1:35: jobs[0].launch_stage: "stable" is not one of alpha, beta, ga`,
+		"jobs: [{name: test, launch_stage: Beta}]":                     "",
+		"jobs: [{name: test, tasks: '${TASKS}', timeout: '${T}'}]":     "",
+		"jobs: [{name: test, trigger: {retry_count: many}}]":           `jobs.yml:1:44: jobs[0].trigger.retry_count: expected integer or a placeholder, got "many"`,
+		"jobs: [{name: Test}]":                                         `jobs.yml:1:15: jobs[0].name: invalid value "Test": ` + schemaFields["job.name"].Description,
+		"jobs: [{name: test, tasks: 0}]":                               `jobs.yml:1:28: jobs[0].tasks: 0 is less than the minimum of 1`,
+		"jobs: {name: test}":                                           `jobs.yml:1:7: jobs: expected array, got a mapping`,
+		"jobs: [{name: test, env: [{name: FOO, secret_version: v1}]}]": `jobs.yml:1:55: jobs[0].env[0].secret_version: invalid value "v1": ` + schemaFields["envVar.secret_version"].Description,
+	}
+	s := jobsSchema()
+	for in, want := range tests {
+		var doc yaml.Node
+		require.NoError(t, yaml.Unmarshal([]byte(in), &doc))
+		err := validateSchema("jobs.yml", doc.Content[0], s, s.Defs, "").err()
+		if want == "" {
+			require.NoError(t, err, in)
+		} else {
+			require.EqualError(t, err, want, in)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"context"
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// secretChecker verifies the secrets referenced by jobs, caching the API
+// responses shared by several jobs.
+type secretChecker struct {
+	c        *service
+	secrets  map[string]error
+	versions map[string]error
+	policies map[string]*iampb.Policy
+}
+
+// checkSecrets verifies, for every secret referenced by the env of the jobs,
+// that the secret and the version exist and that the version is enabled. The
+// service account of the job must be granted access to the secrets apply does
+// not grant it, see jobBindings, on the secret or on its project. Access
+// granted through groups cannot be verified and is reported as missing.
+// Secrets in pending, which a dry run would create, are not checked. All
+// problems are reported together.
+func (c *service) checkSecrets(ctx context.Context, jobs []job, pending map[string]bool) error {
+	checker := &secretChecker{
+		c:        c,
+		secrets:  map[string]error{},
+		versions: map[string]error{},
+		policies: map[string]*iampb.Policy{},
+	}
+
+	var errs errorList
+	for _, j := range jobs {
+		for _, e := range j.Env {
+			if e.Secret == "" || pending[secretName(c.project, e.Secret)] {
+				continue
+			}
+			err := checker.check(ctx, j, e)
+			if err != nil {
+				pos := j.pos
+				if o, ok := j.origins[fmt.Sprintf("env[%s].secret", e.Name)]; ok {
+					pos = o.Pos
+				}
+				errs = append(errs, positionError{pos, fmt.Sprintf("job %q: env %q: %s", j.Name, e.Name, err)})
+			}
+		}
+	}
+	return errs.err()
+}
+
+func (sc *secretChecker) check(ctx context.Context, j job, e envVar) error {
+	name := secretName(sc.c.project, e.Secret)
+	version := e.SecretVersion
+	if version == "" {
+		version = "latest"
+	}
+
+	if err, ok := sc.secrets[name]; !ok {
+		_, err = sc.c.secrets.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: name})
+		sc.secrets[name] = err
+	}
+	if err := sc.secrets[name]; status.Code(err) == codes.NotFound {
+		return errors.Errorf("secret %s does not exist", name)
+	} else if err != nil {
+		return errors.Errorf("could not get secret %s: %s", name, err)
+	}
+
+	versionName := name + "/versions/" + version
+	if _, ok := sc.versions[versionName]; !ok {
+		v, err := sc.c.secrets.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{Name: versionName})
+		if err == nil && v.State != secretmanagerpb.SecretVersion_ENABLED {
+			err = errors.Errorf("version %s of secret %s is %s", lastSegment(v.Name), name, strings.ToLower(v.State.String()))
+		}
+		sc.versions[versionName] = err
+	}
+	if err := sc.versions[versionName]; status.Code(err) == codes.NotFound {
+		return errors.Errorf("version %s of secret %s does not exist", version, name)
+	} else if err != nil {
+		return err
+	}
+
+	account := sc.c.jobAccount(j)
+	b := iamBinding{Resource: name, Role: secretAccessorRole, Member: "serviceAccount:" + account}
+	if account == "" || pie.Contains(sc.c.jobBindings(j), b) {
+		return nil
+	}
+	granted, err := sc.c.grants(b, sc.policy(ctx))
+	if err != nil {
+		return err
+	}
+	if !granted {
+		return errors.Errorf("service account %s cannot access secret %s, grant it %s", account, name, secretAccessorRole)
+	}
+	return nil
+}
+
+// policy returns the cached lookup of the IAM policies of resources.
+func (sc *secretChecker) policy(ctx context.Context) func(resource string) (*iampb.Policy, error) {
+	return func(resource string) (*iampb.Policy, error) {
+		if p, ok := sc.policies[resource]; ok {
+			return p, nil
+		}
+		p, err := sc.c.getIamPolicy(ctx, resource)
+		if err != nil {
+			return nil, err
+		}
+		sc.policies[resource] = p
+		return p, nil
+	}
+}
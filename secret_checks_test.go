@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_CheckSecrets(t *testing.T) {
+	fake := newFakeSecretManager()
+	fake.put("projects/test/secrets/db-password", "one")
+	fake.put("projects/test/secrets/db-password", "two")
+	fake.disabled["projects/test/secrets/db-password/versions/1"] = true
+	fake.put("projects/shared/secrets/api-key", "key")
+	fake.put("projects/shared/secrets/token", "token")
+	fake.policies.grant("projects/shared/secrets/api-key", secretAccessorRole, "serviceAccount:other@test")
+	projects := fakePolicies{}
+	projects.grant("projects/shared", "roles/owner", "serviceAccount:runner@test")
+	svc := &service{project: "test", secrets: fake, projects: projects}
+
+	valid := job{Name: "valid", ServiceAccount: "runner@test", Env: []envVar{
+		{Name: "PLAIN", Value: "value"},
+		{Name: "DB_PASSWORD", Secret: "db-password"},
+		{Name: "DB_PASSWORD_2", Secret: "db-password", SecretVersion: "2"},
+		{Name: "API_KEY", Secret: "projects/shared/secrets/api-key"},
+		{Name: "TOKEN", Secret: "projects/shared/secrets/token"},
+	}}
+	require.NoError(t, svc.checkSecrets(context.Background(), []job{valid}, nil))
+
+	invalid := job{
+		Name:           "invalid",
+		ServiceAccount: "other@test",
+		pos:            position{File: "jobs.yml", Line: 2, Column: 5},
+		origins:        map[string]origin{"env[MISSING].secret": {Source: "job", Pos: position{File: "jobs.yml", Line: 7, Column: 17}}},
+		Env: []envVar{
+			{Name: "MISSING", Secret: "missing"},
+			{Name: "OLD", Secret: "db-password", SecretVersion: "1"},
+			{Name: "FUTURE", Secret: "db-password", SecretVersion: "3"},
+			{Name: "API_KEY", Secret: "projects/shared/secrets/api-key"},
+			{Name: "DENIED", Secret: "projects/shared/secrets/token"},
+		},
+	}
+	err := svc.checkSecrets(context.Background(), []job{invalid}, nil)
+	require.EqualError(t, err, `jobs.yml:7:17: job "invalid": env "MISSING": secret projects/test/secrets/missing does not exist
+jobs.yml:2:5: job "invalid": env "OLD": version 1 of secret projects/test/secrets/db-password is disabled
+jobs.yml:2:5: job "invalid": env "FUTURE": version 3 of secret projects/test/secrets/db-password does not exist
+jobs.yml:2:5: job "invalid": env "DENIED": service account other@test cannot access secret projects/shared/secrets/token, grant it roles/secretmanager.secretAccessor`)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"regexp"
+	"strings"
+)
+
+// secretManager is the subset of the Secret Manager client used by gruns, so
+// that it can be faked in tests.
+type secretManager interface {
+	GetSecret(ctx context.Context, req *secretmanagerpb.GetSecretRequest, opts ...gax.CallOption) (*secretmanagerpb.Secret, error)
+	CreateSecret(ctx context.Context, req *secretmanagerpb.CreateSecretRequest, opts ...gax.CallOption) (*secretmanagerpb.Secret, error)
+	AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest, opts ...gax.CallOption) (*secretmanagerpb.AccessSecretVersionResponse, error)
+	AddSecretVersion(ctx context.Context, req *secretmanagerpb.AddSecretVersionRequest, opts ...gax.CallOption) (*secretmanagerpb.SecretVersion, error)
+	GetSecretVersion(ctx context.Context, req *secretmanagerpb.GetSecretVersionRequest, opts ...gax.CallOption) (*secretmanagerpb.SecretVersion, error)
+	GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest, opts ...gax.CallOption) (*iampb.Policy, error)
+	SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest, opts ...gax.CallOption) (*iampb.Policy, error)
+}
+
+// iamPolicyClient reads and updates the IAM policies of resources, e.g.
+// projects or run jobs.
+type iamPolicyClient interface {
+	GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest, opts ...gax.CallOption) (*iampb.Policy, error)
+	SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest, opts ...gax.CallOption) (*iampb.Policy, error)
+}
+
+const (
+	envFromSecretReferences = "references"
+	envFromSecretValues     = "values"
+)
+
+// secretSourceLabel marks the secrets gruns derives from a key of a JSON
+// secret with the id of that secret.
+const secretSourceLabel = "gruns-source"
+
+// maxLabelValueLength is the longest label value Secret Manager accepts.
+const maxLabelValueLength = 63
+
+var envNameInvalidChars = regexp.MustCompile(`[^A-Z0-9_]`)
+var secretIdInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// sourceLabelValue returns the value of the secretSourceLabel for the secret
+// id. Ids longer than a label value are truncated and suffixed with a hash of
+// the whole id, so that they stay distinct.
+func sourceLabelValue(id string) string {
+	value := strings.ToLower(id)
+	if len(value) <= maxLabelValueLength {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	hash := hex.EncodeToString(sum[:])[:8]
+	return value[:maxLabelValueLength-len(hash)-1] + "-" + hash
+}
+
+// secretName returns the full resource name of secret, a secret id or a full
+// name, in project.
+func secretName(project, secret string) string {
+	if strings.HasPrefix(secret, "projects/") {
+		return secret
+	}
+	return fmt.Sprintf("projects/%s/secrets/%s", project, secret)
+}
+
+// expandSecretEnv replaces the env_from_secret entries of the jobs by one env
+// var per top-level key of the JSON secrets they refer to. In references mode
+// every key is stored in a secret of its own, <secret>-<key>, which gets a new
+// version only when the value of the key changes. In values mode the values
+// end up in the job as literal env vars. Unless dryRun is set the derived
+// secrets are created and updated. The returned changes describe the secrets
+// that were or would be written, never their content.
+func (c *service) expandSecretEnv(ctx context.Context, jobs []job, dryRun bool) ([]job, []string, error) {
+	var changes []string
+	var errs errorList
+	payloads := map[string]map[string]string{}
+	synced := map[string]string{}
+
+	for i, j := range jobs {
+		if len(j.EnvFromSecret) == 0 {
+			continue
+		}
+		explicit := map[string]bool{}
+		for _, e := range j.Env {
+			explicit[e.Name] = true
+		}
+		expandedBy := map[string]string{}
+
+		env := j.Env
+		for _, from := range j.EnvFromSecret {
+			name := secretName(c.project, from.Secret)
+			version := from.SecretVersion
+			if version == "" {
+				version = "latest"
+			}
+			key := name + "/versions/" + version
+			values, ok := payloads[key]
+			if !ok {
+				var err error
+				values, err = c.accessJsonSecret(ctx, key)
+				if err != nil {
+					errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: env_from_secret %s: %s", j.Name, from.Secret, err)})
+					continue
+				}
+				payloads[key] = values
+			}
+
+			for _, k := range pie.Sort(pie.Keys(values)) {
+				envName := from.Prefix + envNameInvalidChars.ReplaceAllString(strings.ToUpper(k), "_")
+				if explicit[envName] {
+					continue
+				}
+				if other, ok := expandedBy[envName]; ok {
+					errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: env %q is expanded from both %s and %s", j.Name, envName, other, from.Secret)})
+					continue
+				}
+				expandedBy[envName] = from.Secret
+
+				if from.Mode == envFromSecretValues {
+					env = append(env, envVar{Name: envName, Value: values[k], sensitive: true})
+					continue
+				}
+
+				derived := name + "-" + secretIdInvalidChars.ReplaceAllString(k, "_")
+				if id := lastSegment(derived); !secretIdRegex.MatchString(id) {
+					errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: env_from_secret %s: key %q would be stored in secret %q, which is not a valid secret id, ids are at most 255 letters, digits, - or _", j.Name, from.Secret, k, id)})
+					continue
+				}
+				derivedVersion, ok := synced[derived]
+				if !ok {
+					var change string
+					var err error
+					derivedVersion, change, err = c.syncSecret(ctx, derived, map[string]string{secretSourceLabel: sourceLabelValue(lastSegment(name))}, values[k], dryRun)
+					if err != nil {
+						errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: env_from_secret %s: %s", j.Name, from.Secret, err)})
+						continue
+					}
+					synced[derived] = derivedVersion
+					if change != "" {
+						changes = append(changes, change)
+					}
+				}
+				env = append(env, envVar{Name: envName, Secret: derived, SecretVersion: derivedVersion})
+			}
+		}
+		jobs[i].Env = env
+		jobs[i].EnvFromSecret = nil
+	}
+	return jobs, changes, errs.err()
+}
+
+// accessJsonSecret returns the top-level values of the JSON object stored in
+// the secret version name. Errors never include the content of the secret.
+func (c *service) accessJsonSecret(ctx context.Context, name string) (map[string]string, error) {
+	res, err := c.secrets.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: name})
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]json.RawMessage
+	if json.Unmarshal(res.GetPayload().GetData(), &doc) != nil {
+		return nil, errors.New("secret is not a JSON object")
+	}
+	values := map[string]string{}
+	for k, raw := range doc {
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			values[k] = s
+			continue
+		}
+		var compact bytes.Buffer
+		if json.Compact(&compact, raw) != nil {
+			return nil, errors.New("secret is not a JSON object")
+		}
+		values[k] = compact.String()
+	}
+	return values, nil
+}
+
+// syncSecret makes sure the latest version of the secret name holds value,
+// creating the secret with labels or adding a version when it does not, and
+// returns that version. In dry run mode nothing is written and a version that
+// would be added is returned as latest.
+func (c *service) syncSecret(ctx context.Context, name string, labels map[string]string, value string, dryRun bool) (string, string, error) {
+	res, err := c.secrets.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: name + "/versions/latest"})
+	switch {
+	case err == nil && string(res.GetPayload().GetData()) == value:
+		return lastSegment(res.Name), "", nil
+	case err != nil && status.Code(err) != codes.NotFound:
+		return "", "", err
+	}
+
+	created := false
+	if _, err := c.secrets.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: name}); status.Code(err) == codes.NotFound {
+		created = true
+	} else if err != nil {
+		return "", "", err
+	}
+
+	change := fmt.Sprintf("~ secret %s (new version)", lastSegment(name))
+	if created {
+		change = fmt.Sprintf("+ secret %s", lastSegment(name))
+	}
+	if dryRun {
+		return "latest", change, nil
+	}
+
+	if created {
+		secretLabels := map[string]string{"managed_by": tag}
+		for k, v := range labels {
+			secretLabels[k] = v
+		}
+		parent, id, _ := strings.Cut(name, "/secrets/")
+		_, err = c.secrets.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+			Parent:   parent,
+			SecretId: id,
+			Secret: &secretmanagerpb.Secret{
+				Labels:      secretLabels,
+				Replication: &secretmanagerpb.Replication{Replication: &secretmanagerpb.Replication_Automatic_{Automatic: &secretmanagerpb.Replication_Automatic{}}},
+			},
+		})
+		if err != nil {
+			return "", "", err
+		}
+	}
+	version, err := c.secrets.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  name,
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte(value)},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	log.Debug().Msgf("added secret version %s", version.Name)
+	return lastSegment(version.Name), change, nil
+}
+
+func lastSegment(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
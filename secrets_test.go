@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"context"
+	"fmt"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeSecretManager keeps secrets and their versions in memory.
+type fakeSecretManager struct {
+	secrets  map[string]*secretmanagerpb.Secret
+	versions map[string][]string
+	disabled map[string]bool
+	policies fakePolicies
+	writes   int
+}
+
+func newFakeSecretManager() *fakeSecretManager {
+	return &fakeSecretManager{
+		secrets:  map[string]*secretmanagerpb.Secret{},
+		versions: map[string][]string{},
+		disabled: map[string]bool{},
+		policies: fakePolicies{},
+	}
+}
+
+// fakePolicies holds IAM policies by resource name.
+type fakePolicies map[string]*iampb.Policy
+
+func (f fakePolicies) grant(resource, role, member string) {
+	if f[resource] == nil {
+		f[resource] = &iampb.Policy{}
+	}
+	f[resource].Bindings = append(f[resource].Bindings, &iampb.Binding{Role: role, Members: []string{member}})
+}
+
+func (f fakePolicies) GetIamPolicy(_ context.Context, req *iampb.GetIamPolicyRequest, _ ...gax.CallOption) (*iampb.Policy, error) {
+	if p, ok := f[req.Resource]; ok {
+		return p, nil
+	}
+	return &iampb.Policy{}, nil
+}
+
+func (f fakePolicies) SetIamPolicy(_ context.Context, req *iampb.SetIamPolicyRequest, _ ...gax.CallOption) (*iampb.Policy, error) {
+	f[req.Resource] = req.Policy
+	return req.Policy, nil
+}
+
+func (f *fakeSecretManager) put(name, value string) {
+	if _, ok := f.secrets[name]; !ok {
+		f.secrets[name] = &secretmanagerpb.Secret{Name: name}
+	}
+	f.versions[name] = append(f.versions[name], value)
+}
+
+func (f *fakeSecretManager) GetSecret(_ context.Context, req *secretmanagerpb.GetSecretRequest, _ ...gax.CallOption) (*secretmanagerpb.Secret, error) {
+	s, ok := f.secrets[req.Name]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "secret not found")
+	}
+	return s, nil
+}
+
+func (f *fakeSecretManager) CreateSecret(_ context.Context, req *secretmanagerpb.CreateSecretRequest, _ ...gax.CallOption) (*secretmanagerpb.Secret, error) {
+	f.writes++
+	for _, v := range req.Secret.Labels {
+		if len(v) > maxLabelValueLength {
+			return nil, status.Error(codes.InvalidArgument, "label values must be at most 63 characters")
+		}
+	}
+	name := req.Parent + "/secrets/" + req.SecretId
+	s := req.Secret
+	s.Name = name
+	f.secrets[name] = s
+	return s, nil
+}
+
+func (f *fakeSecretManager) AccessSecretVersion(_ context.Context, req *secretmanagerpb.AccessSecretVersionRequest, _ ...gax.CallOption) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	name, version, _ := strings.Cut(req.Name, "/versions/")
+	versions := f.versions[name]
+	n := len(versions)
+	if version != "latest" {
+		n, _ = strconv.Atoi(version)
+	}
+	if n == 0 || n > len(versions) {
+		return nil, status.Error(codes.NotFound, "version not found")
+	}
+	return &secretmanagerpb.AccessSecretVersionResponse{
+		Name:    fmt.Sprintf("%s/versions/%d", name, n),
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte(versions[n-1])},
+	}, nil
+}
+
+func (f *fakeSecretManager) GetSecretVersion(_ context.Context, req *secretmanagerpb.GetSecretVersionRequest, _ ...gax.CallOption) (*secretmanagerpb.SecretVersion, error) {
+	res, err := f.AccessSecretVersion(context.Background(), &secretmanagerpb.AccessSecretVersionRequest{Name: req.Name})
+	if err != nil {
+		return nil, err
+	}
+	state := secretmanagerpb.SecretVersion_ENABLED
+	if f.disabled[res.Name] {
+		state = secretmanagerpb.SecretVersion_DISABLED
+	}
+	return &secretmanagerpb.SecretVersion{Name: res.Name, State: state}, nil
+}
+
+func (f *fakeSecretManager) GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest, opts ...gax.CallOption) (*iampb.Policy, error) {
+	return f.policies.GetIamPolicy(ctx, req, opts...)
+}
+
+func (f *fakeSecretManager) SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest, opts ...gax.CallOption) (*iampb.Policy, error) {
+	f.writes++
+	return f.policies.SetIamPolicy(ctx, req, opts...)
+}
+
+func (f *fakeSecretManager) AddSecretVersion(_ context.Context, req *secretmanagerpb.AddSecretVersionRequest, _ ...gax.CallOption) (*secretmanagerpb.SecretVersion, error) {
+	f.writes++
+	if _, ok := f.secrets[req.Parent]; !ok {
+		return nil, status.Error(codes.NotFound, "secret not found")
+	}
+	f.versions[req.Parent] = append(f.versions[req.Parent], string(req.Payload.Data))
+	return &secretmanagerpb.SecretVersion{Name: fmt.Sprintf("%s/versions/%d", req.Parent, len(f.versions[req.Parent]))}, nil
+}
+
+func Test_ExpandSecretEnv(t *testing.T) {
+	fake := newFakeSecretManager()
+	fake.put("projects/test/secrets/db", `{"host": "db.internal", "password": "s3cret", "port": 5432}`)
+	fake.put("projects/test/secrets/db-host", "db.internal")
+	svc := &service{project: "test", secrets: fake}
+	ctx := context.Background()
+
+	newJobs := func() []job {
+		return []job{{
+			Name:          "export",
+			Env:           []envVar{{Name: "DB_PORT", Value: "6543"}},
+			EnvFromSecret: []envFromSecret{{Secret: "db", Prefix: "DB_"}},
+		}}
+	}
+
+	jobs, changes, err := svc.expandSecretEnv(ctx, newJobs(), true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"+ secret db-password"}, changes)
+	require.Equal(t, 0, fake.writes)
+	require.Nil(t, jobs[0].EnvFromSecret)
+	require.Equal(t, []envVar{
+		{Name: "DB_PORT", Value: "6543"},
+		{Name: "DB_HOST", Secret: "projects/test/secrets/db-host", SecretVersion: "1"},
+		{Name: "DB_PASSWORD", Secret: "projects/test/secrets/db-password", SecretVersion: "latest"},
+	}, jobs[0].Env)
+
+	jobs, changes, err = svc.expandSecretEnv(ctx, newJobs(), false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"+ secret db-password"}, changes)
+	require.Equal(t, "1", jobs[0].Env[2].SecretVersion)
+	require.Equal(t, map[string]string{"managed_by": tag, secretSourceLabel: "db"}, fake.secrets["projects/test/secrets/db-password"].Labels)
+
+	fake.put("projects/test/secrets/db", `{"host": "db2.internal", "password": "s3cret"}`)
+	jobs, changes, err = svc.expandSecretEnv(ctx, newJobs(), false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"~ secret db-host (new version)"}, changes)
+	require.Equal(t, envVar{Name: "DB_HOST", Secret: "projects/test/secrets/db-host", SecretVersion: "2"}, jobs[0].Env[1])
+	require.Equal(t, "1", jobs[0].Env[2].SecretVersion)
+}
+
+func Test_ExpandSecretEnvLongIds(t *testing.T) {
+	long := "Db" + strings.Repeat("x", 80)
+	fake := newFakeSecretManager()
+	fake.put("projects/test/secrets/"+long, `{"password": "s3cret"}`)
+	fake.put("projects/test/secrets/db", fmt.Sprintf(`{%q: "s3cret"}`, strings.Repeat("k", 253)))
+	svc := &service{project: "test", secrets: fake}
+
+	jobs, _, err := svc.expandSecretEnv(context.Background(), []job{{
+		Name:          "export",
+		EnvFromSecret: []envFromSecret{{Secret: long}},
+	}}, false)
+	require.NoError(t, err)
+	label := fake.secrets["projects/test/secrets/"+long+"-password"].Labels[secretSourceLabel]
+	require.Len(t, label, maxLabelValueLength)
+	require.True(t, strings.HasPrefix(label, "db"+strings.Repeat("x", 40)), label)
+	require.Equal(t, label, sourceLabelValue(long))
+	require.NotEqual(t, label, sourceLabelValue(long+"y"))
+	require.Equal(t, "projects/test/secrets/"+long+"-password", jobs[0].Env[0].Secret)
+
+	_, _, err = svc.expandSecretEnv(context.Background(), []job{{
+		Name:          "export",
+		pos:           position{File: "jobs.yml", Line: 3, Column: 5},
+		EnvFromSecret: []envFromSecret{{Secret: "db"}},
+	}}, true)
+	require.ErrorContains(t, err, `jobs.yml:3:5: job "export": env_from_secret db: key "kkk`)
+	require.ErrorContains(t, err, `which is not a valid secret id`)
+}
+
+func Test_ExpandSecretEnvValues(t *testing.T) {
+	fake := newFakeSecretManager()
+	fake.put("projects/test/secrets/db", `{"user": "app", "options": {"ssl": true}}`)
+	fake.put("projects/test/secrets/broken", `{"password": "s3cret"`)
+	svc := &service{project: "test", secrets: fake}
+
+	jobs, _, err := svc.expandSecretEnv(context.Background(), []job{{
+		Name:          "export",
+		EnvFromSecret: []envFromSecret{{Secret: "db", Mode: envFromSecretValues}},
+	}}, true)
+	require.NoError(t, err)
+	require.Equal(t, []envVar{
+		{Name: "OPTIONS", Value: `{"ssl":true}`, sensitive: true},
+		{Name: "USER", Value: "app", sensitive: true},
+	}, jobs[0].Env)
+
+	n, err := jobNode(jobs[0])
+	require.NoError(t, err)
+	var out job
+	require.NoError(t, n.Decode(&out))
+	require.Equal(t, redacted, out.Env[1].Value)
+
+	_, _, err = svc.expandSecretEnv(context.Background(), []job{{
+		Name:          "export",
+		EnvFromSecret: []envFromSecret{{Secret: "broken"}, {Secret: "missing"}},
+	}}, true)
+	require.ErrorContains(t, err, `job "export": env_from_secret broken: secret is not a JSON object`)
+	require.ErrorContains(t, err, `job "export": env_from_secret missing: rpc error: code = NotFound`)
+	require.NotContains(t, err.Error(), "s3cret")
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	admin "cloud.google.com/go/iam/admin/apiv1"
+	resourcemanager "cloud.google.com/go/resourcemanager/apiv3"
 	run "cloud.google.com/go/run/apiv2"
 	scheduler "cloud.google.com/go/scheduler/apiv1"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"context"
 	"github.com/rs/zerolog/log"
+	iamv1 "google.golang.org/api/iam/v1"
 	"google.golang.org/api/option"
 )
 
 type service struct {
 	jobclient             *run.JobsClient
 	cscclient             *scheduler.CloudSchedulerClient
+	secrets               secretManager
+	projects              iamPolicyClient
+	jobPolicies           iamPolicyClient
+	accounts              serviceAccountAdmin
 	project               string
 	region                string
 	defaultServiceAccount string
@@ -29,9 +37,33 @@ func initializeService(ctx context.Context, args args) *service {
 		log.Fatal().Msg(err.Error())
 	}
 
+	secrets, err := secretmanager.NewClient(ctx, option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	projects, err := resourcemanager.NewProjectsClient(ctx, option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	accounts, err := admin.NewIamClient(ctx, option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	accountsRest, err := iamv1.NewService(ctx, option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
 	return &service{
 		cscclient:             cscclient,
 		jobclient:             jobclient,
+		secrets:               secrets,
+		projects:              projects,
+		jobPolicies:           jobclient,
+		accounts:              iamAdmin{accounts, accountsRest},
 		project:               args.ProjectId,
 		region:                args.Region,
 		defaultServiceAccount: args.ServiceAccount,
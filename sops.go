@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sopsValueRegex matches the values encrypted by SOPS.
+var sopsValueRegex = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:([a-z]+)\]$`)
+
+// sopsMetadata is the part of the sops key of an encrypted file needed to
+// decrypt it with age.
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string
+		Enc       string
+	}
+	LastModified     string `yaml:"lastmodified"`
+	Mac              string
+	MacOnlyEncrypted bool `yaml:"mac_only_encrypted"`
+}
+
+// decryptSopsFile decrypts a YAML file encrypted by SOPS with age and returns
+// its document without the sops metadata. The age identities are read from
+// SOPS_AGE_KEY or from the file named by SOPS_AGE_KEY_FILE, which defaults to
+// the sops/age/keys.txt file in the user's config directory. The MAC of the
+// file is verified.
+func decryptSopsFile(file string) (*yaml.Node, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Errorf("could not read encrypted file %s", file)
+	}
+	var doc yaml.Node
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s", file)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.Errorf("%s is not a sops encrypted file", file)
+	}
+	body := doc.Content[0]
+
+	metaNode := mappingValue(body, "sops")
+	if metaNode == nil {
+		return nil, errors.Errorf("%s is not a sops encrypted file", file)
+	}
+	var meta sopsMetadata
+	err = metaNode.Decode(&meta)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid sops metadata in %s", file)
+	}
+
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+	key, err := sopsDataKey(meta, identities)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decrypt the data key of %s", file)
+	}
+
+	data := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for i := 0; i+1 < len(body.Content); i += 2 {
+		if body.Content[i].Value != "sops" {
+			data.Content = append(data.Content, body.Content[i], body.Content[i+1])
+		}
+	}
+
+	hash := sha512.New()
+	err = sopsDecryptNode(data, key, nil, func(value string, encrypted bool) {
+		if encrypted || !meta.MacOnlyEncrypted {
+			hash.Write([]byte(value))
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decrypt %s", file)
+	}
+
+	mac, err := sopsDecryptValue(meta.Mac, key, meta.LastModified)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decrypt the MAC of %s", file)
+	}
+	if !strings.EqualFold(mac, fmt.Sprintf("%X", hash.Sum(nil))) {
+		return nil, errors.Errorf("MAC mismatch in %s, the file was modified after it was encrypted", file)
+	}
+	return data, nil
+}
+
+func ageIdentities() ([]age.Identity, error) {
+	if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+		ids, err := age.ParseIdentities(strings.NewReader(key))
+		return ids, errors.Wrap(err, "invalid SOPS_AGE_KEY")
+	}
+
+	file := os.Getenv("SOPS_AGE_KEY_FILE")
+	if file == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, errors.New("SOPS_AGE_KEY and SOPS_AGE_KEY_FILE are not set")
+		}
+		file = filepath.Join(dir, "sops", "age", "keys.txt")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Errorf("could not read the age keys in %s, set SOPS_AGE_KEY or SOPS_AGE_KEY_FILE", file)
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	return ids, errors.Wrapf(err, "invalid age keys in %s", file)
+}
+
+// sopsDataKey decrypts the data key of the file with the first age recipient
+// one of identities can decrypt.
+func sopsDataKey(meta sopsMetadata, identities []age.Identity) ([]byte, error) {
+	if len(meta.Age) == 0 {
+		return nil, errors.New("the file is not encrypted for age")
+	}
+	var lastErr error
+	for _, recipient := range meta.Age {
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(recipient.Enc)), identities...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return io.ReadAll(r)
+	}
+	return nil, lastErr
+}
+
+// sopsDecryptNode decrypts the values below n in place. The additional data
+// of a value is the path of mapping keys leading to it, each followed by a
+// colon. visit is called with the MAC representation of every value in
+// document order. Comments, which SOPS encrypts and leaves out of the MAC,
+// are dropped.
+func sopsDecryptNode(n *yaml.Node, key []byte, path []string, visit func(value string, encrypted bool)) error {
+	n.HeadComment, n.LineComment, n.FootComment = "", "", ""
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i]
+			k.HeadComment, k.LineComment, k.FootComment = "", "", ""
+			err := sopsDecryptNode(n.Content[i+1], key, append(path[:len(path):len(path)], n.Content[i].Value), visit)
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range n.Content {
+			err := sopsDecryptNode(item, key, path, visit)
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !sopsValueRegex.MatchString(n.Value) {
+			visit(sopsMacValue(n), false)
+			return nil
+		}
+		typ := sopsValueRegex.FindStringSubmatch(n.Value)[4]
+		value, err := sopsDecryptValue(n.Value, key, strings.Join(path, ":")+":")
+		if err != nil {
+			return errors.Wrapf(err, "%s", strings.Join(path, "."))
+		}
+		tag, ok := sopsTypeTags[typ]
+		if !ok {
+			return errors.Errorf("%s: unknown value type %q", strings.Join(path, "."), typ)
+		}
+		n.Value, n.Tag, n.Style = value, tag, 0
+		visit(sopsMacValue(n), true)
+	}
+	return nil
+}
+
+// sopsDecryptValue decrypts an ENC[AES256_GCM,...] value with the data key.
+func sopsDecryptValue(value string, key []byte, additionalData string) (string, error) {
+	m := sopsValueRegex.FindStringSubmatch(value)
+	if m == nil {
+		return "", errors.New("invalid encrypted value")
+	}
+	data, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		return "", errors.New("invalid encrypted value")
+	}
+	iv, err := base64.StdEncoding.DecodeString(m[2])
+	if err != nil {
+		return "", errors.New("invalid encrypted value")
+	}
+	tag, err := base64.StdEncoding.DecodeString(m[3])
+	if err != nil {
+		return "", errors.New("invalid encrypted value")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", err
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return "", errors.New("could not decrypt value, wrong key or modified file")
+	}
+	return string(plain), nil
+}
+
+// sopsTypeTags maps the types of encrypted values to their yaml tags.
+var sopsTypeTags = map[string]string{
+	"str":   "!!str",
+	"bytes": "!!str",
+	"int":   "!!int",
+	"float": "!!float",
+	"bool":  "!!bool",
+}
+
+// sopsMacValue returns the representation of a value that SOPS includes in
+// the MAC: numbers are formatted the way Go formats them, booleans the way
+// Python does and timestamps in RFC 3339.
+func sopsMacValue(n *yaml.Node) string {
+	switch n.Tag {
+	case "!!int":
+		var i int64
+		if n.Decode(&i) == nil {
+			return strconv.FormatInt(i, 10)
+		}
+	case "!!float":
+		var f float64
+		if n.Decode(&f) == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+	case "!!bool":
+		var b bool
+		if n.Decode(&b) == nil {
+			if b {
+				return "True"
+			}
+			return "False"
+		}
+	case "!!timestamp":
+		var t time.Time
+		if n.Decode(&t) == nil {
+			return t.Format(time.RFC3339Nano)
+		}
+	}
+	return n.Value
+}
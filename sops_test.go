@@ -0,0 +1,135 @@
+package main
+
+import (
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useSopsTestKey makes the age key the files in data/sops are encrypted for
+// the key sops files are decrypted with.
+func useSopsTestKey(t *testing.T) {
+	keys, err := filepath.Abs("data/sops/keys.txt")
+	require.NoError(t, err)
+	t.Setenv("SOPS_AGE_KEY", "")
+	t.Setenv("SOPS_AGE_KEY_FILE", keys)
+}
+
+// copyFile copies the fixture src to dst.
+func copyFile(t *testing.T, src, dst string) {
+	b, err := os.ReadFile(src)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dst, b, 0o600))
+}
+
+// decryptSopsTestFile decrypts file and decodes its document.
+func decryptSopsTestFile(t *testing.T, file string) map[string]interface{} {
+	data, err := decryptSopsFile(file)
+	require.NoError(t, err)
+	var doc map[string]interface{}
+	require.NoError(t, data.Decode(&doc))
+	return doc
+}
+
+func Test_DecryptSopsFile(t *testing.T) {
+	useSopsTestKey(t)
+	require.Equal(t, map[string]interface{}{
+		"db": map[string]interface{}{
+			"user":     "app",
+			"password": "s3cret",
+			"port":     5432,
+			"ratio":    1.5,
+			"tls":      true,
+			"rotated":  "2024-03-01T12:00:00Z",
+		},
+		"tokens": []interface{}{"a", "b"},
+	}, decryptSopsTestFile(t, "data/sops/types.enc.yml"))
+
+	// The encrypted comments are dropped.
+	data, err := decryptSopsFile("data/sops/types.enc.yml")
+	require.NoError(t, err)
+	out, err := yaml.Marshal(data)
+	require.NoError(t, err)
+	require.NotContains(t, string(out), "ENC[")
+	require.NotContains(t, string(out), "#")
+}
+
+func Test_DecryptSopsFile_Unencrypted(t *testing.T) {
+	useSopsTestKey(t)
+
+	// Unencrypted numbers are in the MAC as Go formats them, 1.5 for 1.50.
+	require.Equal(t, map[string]interface{}{
+		"password":          "s3cret",
+		"host_unencrypted":  "db.internal",
+		"port_unencrypted":  5432,
+		"ratio_unencrypted": 1.5,
+		"scale_unencrypted": 1000.0,
+		"tls_unencrypted":   true,
+	}, decryptSopsTestFile(t, "data/sops/suffix.enc.yml"))
+
+	require.Equal(t, map[string]interface{}{
+		"password": "s3cret",
+		"public":   map[string]interface{}{"host": "db.internal", "ratio": 2.5},
+	}, decryptSopsTestFile(t, "data/sops/unencrypted_regex.enc.yml"))
+
+	// With mac_only_encrypted the unencrypted values can change.
+	require.Equal(t, map[string]interface{}{
+		"password": "s3cret",
+		"token":    "t0ken",
+		"timeout":  0.1,
+		"replicas": 3,
+		"debug":    false,
+	}, decryptSopsTestFile(t, "data/sops/regex.enc.yml"))
+	b, err := os.ReadFile("data/sops/regex.enc.yml")
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "regex.enc.yml")
+	require.NoError(t, os.WriteFile(file, []byte(strings.Replace(string(b), "replicas: 3", "replicas: 4", 1)), 0o600))
+	require.Equal(t, 4, decryptSopsTestFile(t, file)["replicas"])
+}
+
+func Test_DecryptSopsFile_Errors(t *testing.T) {
+	useSopsTestKey(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "secrets.enc.yml")
+	b, err := os.ReadFile("data/sops/secrets.enc.yml")
+	require.NoError(t, err)
+
+	// Swapping two encrypted values breaks their additional data.
+	var doc yaml.Node
+	require.NoError(t, yaml.Unmarshal(b, &doc))
+	body := doc.Content[0]
+	body.Content[1].Value, body.Content[3].Value = body.Content[3].Value, body.Content[1].Value
+	swapped, err := yaml.Marshal(&doc)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(file, swapped, 0o600))
+	_, err = decryptSopsFile(file)
+	require.ErrorContains(t, err, "password: could not decrypt value")
+
+	// Adding an unencrypted value breaks the MAC.
+	require.NoError(t, os.WriteFile(file, append([]byte("extra: value\n"), b...), 0o600))
+	_, err = decryptSopsFile(file)
+	require.ErrorContains(t, err, "MAC mismatch")
+
+	// So does changing an unencrypted number.
+	suffix, err := os.ReadFile("data/sops/suffix.enc.yml")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(file, []byte(strings.Replace(string(suffix), "ratio_unencrypted: 1.50", "ratio_unencrypted: 1.60", 1)), 0o600))
+	_, err = decryptSopsFile(file)
+	require.ErrorContains(t, err, "MAC mismatch")
+
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	t.Setenv("SOPS_AGE_KEY", other.String())
+	require.NoError(t, os.WriteFile(file, b, 0o600))
+	_, err = decryptSopsFile(file)
+	require.ErrorContains(t, err, "could not decrypt the data key")
+
+	plain := filepath.Join(dir, "plain.yml")
+	require.NoError(t, os.WriteFile(plain, []byte("password: s3cret\n"), 0o600))
+	_, err = decryptSopsFile(plain)
+	require.ErrorContains(t, err, "is not a sops encrypted file")
+}
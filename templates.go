@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+type template struct {
+	node *yaml.Node
+	pos  position
+}
+
+// templateSet holds the templates of all loaded files by name.
+type templateSet map[string]template
+
+// collectTemplates gathers the templates of files, reporting templates that
+// are defined more than once.
+func collectTemplates(files []*jobFile) (templateSet, error) {
+	templates := templateSet{}
+	var errs errorList
+	for _, f := range files {
+		n := mappingValue(f.body, "templates")
+		if n == nil {
+			continue
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			pos := position{File: f.path, Line: key.Line, Column: key.Column}
+			if first, ok := templates[key.Value]; ok {
+				errs = append(errs, positionError{pos, fmt.Sprintf("duplicate template %q, first defined at %s", key.Value, first.pos)})
+				continue
+			}
+			templates[key.Value] = template{node: n.Content[i+1], pos: pos}
+		}
+	}
+	return templates, errs.err()
+}
+
+// extend merges n, defined in file, on top of the chain of templates it
+// extends. The templates of the chain are merged in order, so a template
+// overrides the templates it extends itself.
+func (templates templateSet) extend(file string, n *yaml.Node) (*yaml.Node, error) {
+	return templates.extendChain(file, n, nil)
+}
+
+func (templates templateSet) extendChain(file string, n *yaml.Node, chain []string) (*yaml.Node, error) {
+	extends := mappingValue(n, "extends")
+	if extends == nil || extends.Value == "" {
+		return n, nil
+	}
+	name := extends.Value
+	pos := position{File: file, Line: extends.Line, Column: extends.Column}
+
+	if pie.Contains(chain, name) {
+		return nil, positionError{pos, fmt.Sprintf("template cycle: %s", strings.Join(append(chain, name), " -> "))}
+	}
+	t, ok := templates[name]
+	if !ok {
+		known := pie.Sort(pie.Keys(templates))
+		if len(known) == 0 {
+			return nil, positionError{pos, fmt.Sprintf("unknown template %q, no templates are defined", name)}
+		}
+		return nil, positionError{pos, fmt.Sprintf("unknown template %q, known templates: %s", name, strings.Join(known, ", "))}
+	}
+
+	base, err := templates.extendChain(t.pos.File, t.node, append(chain, name))
+	if err != nil {
+		return nil, err
+	}
+	return mergeNodes(base, n), nil
+}
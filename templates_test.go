@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_ExtendTemplates(t *testing.T) {
+	jobs, err := readJobs("data/templates.yml")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(jobs))
+
+	hourly := jobs[0]
+	require.Equal(t, "dbt", hourly.Image)
+	require.Equal(t, "run", hourly.Args)
+	require.Equal(t, "2", hourly.Cpu)
+	require.Equal(t, "1Gi", hourly.Memory)
+	require.Equal(t, 0, *hourly.Retries)
+	require.Equal(t, map[string]string{"team": "data", "kind": "batch"}, hourly.Labels)
+	require.Equal(t, []envVar{{Name: "DBT_TARGET", Value: "prod"}}, hourly.Env)
+
+	nightly := jobs[1]
+	require.Equal(t, "run --full-refresh", nightly.Args)
+	require.Equal(t, "4Gi", nightly.Memory)
+	require.Equal(t, []envVar{{Name: "DBT_TARGET", Value: "prod"}, {Name: "DBT_THREADS", Value: "8"}}, nightly.Env)
+
+	standalone := jobs[2]
+	require.Equal(t, "test", standalone.Image)
+	require.Equal(t, map[string]string{"team": "data"}, standalone.Labels)
+}
+
+func Test_ExtendTemplatesErrors(t *testing.T) {
+	_, err := readJobs("data/templates_cycle.yml")
+	require.EqualError(t, err, "data/templates_cycle.yml:5:14: template cycle: a -> b -> a")
+
+	_, err = readJobs("data/templates_unknown.yml")
+	require.EqualError(t, err, `data/templates_unknown.yml:6:14: unknown template "dtb", known templates: dbt`)
+}
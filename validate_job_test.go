@@ -1,9 +1,14 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestValidateJob(t *testing.T) {
 	j := job{
+		Name:     "test",
 		Image:    "test",
 		Schedule: "test",
 		Args:     "test",
@@ -14,3 +19,140 @@ func TestValidateJob(t *testing.T) {
 		t.Error("validateJob should not return an error")
 	}
 }
+
+func TestValidateJobRuntimeSettings(t *testing.T) {
+	valid := job{
+		Name:                 "test",
+		Image:                "test",
+		EncryptionKey:        "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+		ExecutionEnvironment: "gen1",
+		LaunchStage:          "GA",
+	}
+	if err := validateJob(valid); err != nil {
+		t.Errorf("validateJob should not return an error: %s", err)
+	}
+
+	invalid := []job{
+		{Image: "test", EncryptionKey: "my-key"},
+		{Image: "test", ExecutionEnvironment: "gen3"},
+		{Image: "test", LaunchStage: "stable"},
+	}
+	for _, j := range invalid {
+		if err := validateJob(j); err == nil {
+			t.Errorf("validateJob should return an error for %+v", j)
+		}
+	}
+}
+
+func TestValidateJobBinaryAuthorization(t *testing.T) {
+	valid := []*binaryAuthorization{
+		{UseDefault: true},
+		{Policy: "projects/p/platforms/cloudRun/prod"},
+		{UseDefault: true, BreakglassJustification: "incident-42"},
+	}
+	for _, ba := range valid {
+		if err := validateJob(job{Name: "test", Image: "test", BinaryAuthorization: ba}); err != nil {
+			t.Errorf("validateJob should not return an error for %+v: %s", ba, err)
+		}
+	}
+
+	invalid := []*binaryAuthorization{
+		{UseDefault: true, Policy: "projects/p/platforms/cloudRun/prod"},
+		{Policy: "prod"},
+		{BreakglassJustification: "incident-42"},
+	}
+	for _, ba := range invalid {
+		if err := validateJob(job{Image: "test", BinaryAuthorization: ba}); err == nil {
+			t.Errorf("validateJob should return an error for %+v", ba)
+		}
+	}
+}
+
+func TestValidateJobsCollectsErrors(t *testing.T) {
+	jobs := []job{
+		{Name: "a", LaunchStage: "stable", pos: position{File: "jobs.yml", Line: 2, Column: 5}},
+		{Name: "b", Image: "test", ExecutionEnvironment: "gen3", pos: position{File: "jobs.yml", Line: 5, Column: 5}},
+	}
+	err := validateJobs(jobs)
+	if err == nil {
+		t.Fatal("validateJobs should return an error")
+	}
+	want := `jobs.yml:2:5: job "a": image cannot be empty
+jobs.yml:2:5: job "a": launch_stage must be one of alpha, beta or ga, got "stable"
+jobs.yml:5:5: job "b": execution_environment must be gen1 or gen2, got "gen3"`
+	if err.Error() != want {
+		t.Errorf("unexpected error:\n%s", err)
+	}
+}
+
+func TestValidateJobCloudRunConstraints(t *testing.T) {
+	valid := []job{
+		{Name: "export-tenant-1", Image: "test", Cpu: "1000m", Memory: "512Mi"},
+		{Name: "small", Image: "test", Cpu: "0.5", Memory: "1Gi"},
+		{Name: "big", Image: "test", Cpu: "8", Memory: "32Gi", Tasks: ptr(100), Parallelism: ptr(10)},
+		{Name: "legacy", Image: "test", Memory: "256Mi", ExecutionEnvironment: "gen1"},
+		{Name: "zero", Image: "test", Retries: ptr(0), Parallelism: ptr(0), Timeout: ptr(duration(24 * time.Hour))},
+		{Name: "env", Image: "test", Env: []envVar{
+			{Name: "FOO", Value: "bar"},
+			{Name: "DB_PASSWORD", Secret: "db-password", SecretVersion: "3"},
+			{Name: "API_KEY", Secret: "projects/p/secrets/api-key", SecretVersion: "latest"},
+		}},
+		{Name: "env-from-secret", Image: "test", EnvFromSecret: []envFromSecret{
+			{Secret: "db", Prefix: "DB_"},
+			{Secret: "projects/p/secrets/api", SecretVersion: "2", Mode: "values"},
+		}},
+		{Name: "roles", Image: "test", Roles: []string{"roles/bigquery.dataEditor", "projects/p/roles/exporter", "organizations/123/roles/auditor"}},
+		{Name: strings.Repeat("a", 63), Image: "test", Schedule: "0 * * * *"},
+	}
+	for _, j := range valid {
+		if err := validateJob(j); err != nil {
+			t.Errorf("validateJob should not return an error for %s: %s", j.Name, err)
+		}
+	}
+
+	invalid := []job{
+		{Name: "Upper", Image: "test"},
+		{Name: "trailing-", Image: "test"},
+		{Name: "1st", Image: "test"},
+		{Name: strings.Repeat("a", 64), Image: "test"},
+		{Name: "cpu", Image: "test", Cpu: "3"},
+		{Name: "cpu", Image: "test", Cpu: "lots"},
+		{Name: "memory", Image: "test", Memory: "64Mi"},
+		{Name: "memory", Image: "test", Memory: "64Gi"},
+		{Name: "combo", Image: "test", Cpu: "1", Memory: "8Gi"},
+		{Name: "combo", Image: "test", Cpu: "4", Memory: "1Gi"},
+		{Name: "combo", Image: "test", Cpu: "250m", Memory: "1Gi"},
+		{Name: "parallel", Image: "test", Tasks: ptr(2), Parallelism: ptr(3)},
+		{Name: "tasks", Image: "test", Tasks: ptr(10001)},
+		{Name: "retries", Image: "test", Retries: ptr(11)},
+		{Name: "timeout", Image: "test", Timeout: ptr(duration(200 * time.Hour))},
+		{Name: "env", Image: "test", Env: []envVar{{Name: "1FOO", Value: "bar"}}},
+		{Name: "env", Image: "test", Env: []envVar{{Name: "CLOUD_RUN_TASK_INDEX", Value: "1"}}},
+		{Name: "env", Image: "test", Env: []envVar{{Name: "FOO", Value: "a"}, {Name: "FOO", Value: "b"}}},
+		{Name: "env", Image: "test", Env: []envVar{{Name: "FOO", Value: "a", Secret: "foo"}}},
+		{Name: "env", Image: "test", Env: []envVar{{Name: "FOO", Secret: "foo", SecretVersion: "v2"}}},
+		{Name: "env", Image: "test", Env: []envVar{{Name: "FOO", Secret: "bad/secret"}}},
+		{Name: "env", Image: "test", Env: []envVar{{Name: "FOO", SecretVersion: "1"}}},
+		{Name: "env-from-secret", Image: "test", EnvFromSecret: []envFromSecret{{}}},
+		{Name: "env-from-secret", Image: "test", EnvFromSecret: []envFromSecret{{Secret: "db", Prefix: "1_"}}},
+		{Name: "env-from-secret", Image: "test", EnvFromSecret: []envFromSecret{{Secret: "db", Mode: "plain"}}},
+		{Name: "env-from-secret", Image: "test", EnvFromSecret: []envFromSecret{{Secret: "db", SecretVersion: "v1"}}},
+		{Name: "roles", Image: "test", Roles: []string{"bigquery.dataEditor"}},
+	}
+	for _, j := range invalid {
+		if err := validateJob(j); err == nil {
+			t.Errorf("validateJob should return an error for %+v", j)
+		}
+	}
+}
+
+func TestValidateJobsDuplicateNames(t *testing.T) {
+	jobs := []job{
+		{Name: "test", Image: "test", pos: position{File: "jobs.yml", Line: 2, Column: 5}},
+		{Name: "test", Image: "test", pos: position{File: "jobs.yml", Line: 6, Column: 5}},
+	}
+	err := validateJobs(jobs)
+	if err == nil || err.Error() != `jobs.yml:6:5: job "test": duplicate job name, first defined at jobs.yml:2:5` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -1,10 +1,132 @@
 package main
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"github.com/elliotchance/pie/v2"
+	"github.com/pkg/errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	// Embed the time zone database so timezone validation works in minimal
+	// container images.
+	_ "time/tzdata"
+)
+
+// Cloud Run and Cloud Scheduler limits, see
+// https://cloud.google.com/run/docs/configuring/jobs and
+// https://cloud.google.com/scheduler/docs/reference/rest/v1/projects.locations.jobs
+const (
+	maxJobNameLength = 63
+	maxTasks         = 10000
+	maxRetries       = 10
+	maxTimeout       = 168 * time.Hour
+)
+
+const (
+	mi = 1 << 20
+	gi = 1 << 30
+)
+
+var encryptionKeyRegex = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+var binauthzPolicyRegex = regexp.MustCompile(`^projects/[^/]+/platforms/cloudRun/[^/]+$`)
+var jobNameRegex = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var labelKeyRegex = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+var labelValueRegex = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+var secretRegex = regexp.MustCompile(`^(projects/[^/]+/secrets/)?[A-Za-z0-9_-]{1,255}$`)
+var roleRegex = regexp.MustCompile(`^(roles|(projects|organizations)/[^/]+/roles)/[A-Za-z0-9_.]+$`)
+var serviceAccountIdRegex = regexp.MustCompile(`^[a-z][-a-z0-9]{4,28}[a-z0-9]$`)
+var secretIdRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{1,255}$`)
+
+// reservedEnvNames are set by Cloud Run and cannot be overridden.
+var reservedEnvNames = []string{
+	"PORT",
+	"K_SERVICE",
+	"K_REVISION",
+	"K_CONFIGURATION",
+	"CLOUD_RUN_JOB",
+	"CLOUD_RUN_EXECUTION",
+	"CLOUD_RUN_TASK_INDEX",
+	"CLOUD_RUN_TASK_ATTEMPT",
+	"CLOUD_RUN_TASK_COUNT",
+}
+
+// cpuLimits lists the cpu values Cloud Run accepts together with the memory
+// range allowed for them. Fractional cpus below 1 are allowed in 1m steps
+// down to 80m.
+var cpuLimits = []struct {
+	maxCpu int64
+	minMem int64
+	maxMem int64
+}{
+	{499, 0, 512 * mi},
+	{999, 0, 1 * gi},
+	{1000, 0, 4 * gi},
+	{2000, 0, 8 * gi},
+	{4000, 2 * gi, 16 * gi},
+	{6000, 4 * gi, 24 * gi},
+	{8000, 4 * gi, 32 * gi},
+}
+
+// validateJobs validates every job and reports all problems at once, each
+// prefixed with the location of the job in its file.
+func validateJobs(jobs []job) error {
+	var errs errorList
+	seen := map[string]job{}
+	for _, j := range jobs {
+		if first, ok := seen[j.Name]; ok {
+			errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: duplicate job name, first defined at %s", j.Name, first.pos)})
+		} else {
+			seen[j.Name] = j
+		}
+
+		var list errorList
+		list.add(validateJob(j))
+		for _, e := range list {
+			errs = append(errs, positionError{j.pos, fmt.Sprintf("job %q: %s", j.Name, e)})
+		}
+	}
+	return errs.err()
+}
 
 func validateJob(j job) error {
+	var errs errorList
+	errs = append(errs, validateName(j)...)
 	if j.Image == "" {
-		return errors.New("image cannot be empty")
+		errs = append(errs, errors.New("image cannot be empty"))
+	}
+	errs = append(errs, validateResources(j)...)
+	errs = append(errs, validateExecution(j)...)
+	errs = append(errs, validateEnv(j.Env)...)
+	errs = append(errs, validateEnvFromSecret(j.EnvFromSecret)...)
+	errs = append(errs, validateLabels(j.Labels)...)
+	errs = append(errs, validateTrigger(j)...)
+	errs = append(errs, validateImagePolicyExemption(j.ImagePolicyExemption)...)
+	for _, role := range j.Roles {
+		if !roleRegex.MatchString(role) {
+			errs = append(errs, errors.Errorf("roles: %q is not a role, expected roles/*, projects/*/roles/* or organizations/*/roles/*", role))
+		}
+	}
+	if j.EncryptionKey != "" && !encryptionKeyRegex.MatchString(j.EncryptionKey) {
+		errs = append(errs, errors.Errorf("encryption_key must be a full KMS key name (projects/*/locations/*/keyRings/*/cryptoKeys/*), got %q", j.EncryptionKey))
+	}
+	if _, ok := executionEnvironments[strings.ToLower(j.ExecutionEnvironment)]; j.ExecutionEnvironment != "" && !ok {
+		errs = append(errs, errors.Errorf("execution_environment must be gen1 or gen2, got %q", j.ExecutionEnvironment))
+	}
+	if _, ok := launchStages[strings.ToLower(j.LaunchStage)]; j.LaunchStage != "" && !ok {
+		errs = append(errs, errors.Errorf("launch_stage must be one of alpha, beta or ga, got %q", j.LaunchStage))
+	}
+	if ba := j.BinaryAuthorization; ba != nil {
+		if ba.UseDefault && ba.Policy != "" {
+			errs = append(errs, errors.New("binary_authorization: use_default and policy are mutually exclusive"))
+		}
+		if ba.Policy != "" && !binauthzPolicyRegex.MatchString(ba.Policy) {
+			errs = append(errs, errors.Errorf("binary_authorization: policy must be a full policy name (projects/*/platforms/cloudRun/*), got %q", ba.Policy))
+		}
+		if ba.BreakglassJustification != "" && !ba.UseDefault && ba.Policy == "" {
+			errs = append(errs, errors.New("binary_authorization: breakglass_justification requires use_default or policy"))
+		}
 	}
 	//if j.Schedule == "" {
 	//	return errors.New("schedule cannot be empty")
@@ -14,5 +136,196 @@ func validateJob(j job) error {
 	//	return errors.New("args cannot be empty")
 	//}
 
-	return nil
+	return errs.err()
+}
+
+func validateName(j job) errorList {
+	var errs errorList
+	switch {
+	case j.Name == "":
+		errs = append(errs, errors.New("name cannot be empty"))
+	case len(j.Name) > maxJobNameLength:
+		errs = append(errs, errors.Errorf("name must be at most %d characters, got %d", maxJobNameLength, len(j.Name)))
+	case !jobNameRegex.MatchString(j.Name):
+		errs = append(errs, errors.New("name must start with a lowercase letter, contain only lowercase letters, digits and hyphens, and not end with a hyphen"))
+	}
+	// The name of the trigger, the name followed by -trigger, always fits in
+	// the 500 characters Cloud Scheduler allows for job ids.
+	return errs
+}
+
+func validateResources(j job) errorList {
+	var errs errorList
+	var cpu, memory int64
+	var err error
+	if j.Cpu != "" {
+		cpu, err = parseCpu(j.Cpu)
+		if err != nil {
+			errs = append(errs, err)
+		} else if !validCpu(cpu) {
+			errs = append(errs, errors.Errorf("cpu must be between 80m and 1, or one of 1, 2, 4, 6 or 8, got %q", j.Cpu))
+			cpu = 0
+		}
+	}
+	if j.Memory != "" {
+		memory, err = parseMemory(j.Memory)
+		if err != nil {
+			errs = append(errs, err)
+		} else if minMem := minMemory(j.ExecutionEnvironment); memory < minMem || memory > 32*gi {
+			errs = append(errs, errors.Errorf("memory must be between %dMi and 32Gi, got %q", minMem/mi, j.Memory))
+			memory = 0
+		}
+	}
+	if cpu == 0 || memory == 0 {
+		return errs
+	}
+	for _, l := range cpuLimits {
+		if cpu > l.maxCpu {
+			continue
+		}
+		minMem := l.minMem
+		if minMem == 0 {
+			minMem = minMemory(j.ExecutionEnvironment)
+		}
+		if memory < minMem || memory > l.maxMem {
+			errs = append(errs, errors.Errorf("cpu %s requires memory between %dMi and %dMi, got %q", j.Cpu, minMem/mi, l.maxMem/mi, j.Memory))
+		}
+		break
+	}
+	return errs
+}
+
+func validCpu(millis int64) bool {
+	if millis >= 80 && millis <= 1000 {
+		return true
+	}
+	switch millis {
+	case 2000, 4000, 6000, 8000:
+		return true
+	}
+	return false
+}
+
+func minMemory(executionEnvironment string) int64 {
+	if strings.ToLower(executionEnvironment) == "gen1" {
+		return 128 * mi
+	}
+	return 512 * mi
+}
+
+func validateExecution(j job) errorList {
+	var errs errorList
+	if j.Tasks != nil && (*j.Tasks < 1 || *j.Tasks > maxTasks) {
+		errs = append(errs, errors.Errorf("tasks must be between 1 and %d, got %d", maxTasks, *j.Tasks))
+	}
+	if j.Parallelism != nil {
+		if *j.Parallelism < 0 {
+			errs = append(errs, errors.Errorf("parallelism cannot be negative, got %d", *j.Parallelism))
+		} else if j.Tasks != nil && *j.Parallelism > *j.Tasks {
+			errs = append(errs, errors.Errorf("parallelism (%d) cannot exceed tasks (%d)", *j.Parallelism, *j.Tasks))
+		}
+	}
+	if j.Retries != nil && (*j.Retries < 0 || *j.Retries > maxRetries) {
+		errs = append(errs, errors.Errorf("retries must be between 0 and %d, got %d", maxRetries, *j.Retries))
+	}
+	if j.Timeout != nil && (*j.Timeout <= 0 || time.Duration(*j.Timeout) > maxTimeout) {
+		errs = append(errs, errors.Errorf("timeout must be greater than 0 and at most %s, got %s", maxTimeout, time.Duration(*j.Timeout)))
+	}
+	return errs
+}
+
+func validateEnv(env []envVar) errorList {
+	var errs errorList
+	seen := map[string]bool{}
+	for _, e := range env {
+		switch {
+		case !envNameRegex.MatchString(e.Name):
+			errs = append(errs, errors.Errorf("env %q: name must contain only letters, digits and underscores and not start with a digit", e.Name))
+		case strings.HasPrefix(e.Name, "X_GOOGLE_") || pie.Contains(reservedEnvNames, e.Name):
+			errs = append(errs, errors.Errorf("env %q: name is reserved by Cloud Run", e.Name))
+		case seen[e.Name]:
+			errs = append(errs, errors.Errorf("env %q: defined more than once", e.Name))
+		}
+		seen[e.Name] = true
+
+		if e.Value != "" && e.Secret != "" {
+			errs = append(errs, errors.Errorf("env %q: value and secret are mutually exclusive", e.Name))
+		}
+		if e.Secret != "" && !secretRegex.MatchString(e.Secret) {
+			errs = append(errs, errors.Errorf("env %q: secret must be a secret id or projects/*/secrets/*, got %q", e.Name, e.Secret))
+		}
+		if e.SecretVersion != "" {
+			if e.Secret == "" {
+				errs = append(errs, errors.Errorf("env %q: secret_version requires secret", e.Name))
+			} else if !validSecretVersion(e.SecretVersion) {
+				errs = append(errs, errors.Errorf("env %q: secret_version must be latest or a positive version number, got %q", e.Name, e.SecretVersion))
+			}
+		}
+	}
+	return errs
+}
+
+func validateEnvFromSecret(from []envFromSecret) errorList {
+	var errs errorList
+	for _, f := range from {
+		switch {
+		case f.Secret == "":
+			errs = append(errs, errors.New("env_from_secret: secret cannot be empty"))
+			continue
+		case !secretRegex.MatchString(f.Secret):
+			errs = append(errs, errors.Errorf("env_from_secret %q: secret must be a secret id or projects/*/secrets/*", f.Secret))
+		}
+		if f.SecretVersion != "" && !validSecretVersion(f.SecretVersion) {
+			errs = append(errs, errors.Errorf("env_from_secret %q: secret_version must be latest or a positive version number, got %q", f.Secret, f.SecretVersion))
+		}
+		if f.Prefix != "" && !envNameRegex.MatchString(f.Prefix) {
+			errs = append(errs, errors.Errorf("env_from_secret %q: prefix must contain only letters, digits and underscores and not start with a digit, got %q", f.Secret, f.Prefix))
+		}
+		if f.Mode != "" && f.Mode != envFromSecretReferences && f.Mode != envFromSecretValues {
+			errs = append(errs, errors.Errorf("env_from_secret %q: mode must be %s or %s, got %q", f.Secret, envFromSecretReferences, envFromSecretValues, f.Mode))
+		}
+	}
+	return errs
+}
+
+func validateLabels(labels map[string]string) errorList {
+	var errs errorList
+	for _, k := range pie.Sort(pie.Keys(labels)) {
+		switch {
+		case k == "managed_by":
+			errs = append(errs, errors.New("label managed_by is reserved for gruns"))
+		case !labelKeyRegex.MatchString(k):
+			errs = append(errs, errors.Errorf("label %q: keys must start with a lowercase letter and contain at most 63 lowercase letters, digits, underscores and hyphens", k))
+		case !labelValueRegex.MatchString(labels[k]):
+			errs = append(errs, errors.Errorf("label %q: values must contain at most 63 lowercase letters, digits, underscores and hyphens, got %q", k, labels[k]))
+		}
+	}
+	return errs
+}
+
+func validateTrigger(j job) errorList {
+	var errs errorList
+	if j.Timezone != "" {
+		if _, err := time.LoadLocation(j.Timezone); err != nil {
+			errs = append(errs, errors.Errorf("timezone %q is not a valid time zone", j.Timezone))
+		}
+	}
+	if j.Trigger == nil {
+		return errs
+	}
+	if j.Trigger.RetryCount != nil && (*j.Trigger.RetryCount < 0 || *j.Trigger.RetryCount > 5) {
+		errs = append(errs, errors.Errorf("trigger.retry_count must be between 0 and 5, got %d", *j.Trigger.RetryCount))
+	}
+	if d := j.Trigger.AttemptDeadline; d != nil && (time.Duration(*d) < 15*time.Second || time.Duration(*d) > 30*time.Minute) {
+		errs = append(errs, errors.Errorf("trigger.attempt_deadline must be between 15s and 30m, got %s", time.Duration(*d)))
+	}
+	return errs
+}
+
+func validSecretVersion(v string) bool {
+	if v == "latest" {
+		return true
+	}
+	n, err := strconv.Atoi(v)
+	return err == nil && n > 0 && strconv.Itoa(n) == v
 }